@@ -3,12 +3,13 @@ package services
 import (
 	"github.com/lab259/go-rscsrv-prometheus/promsql"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var DefaultDriverCollector DriverCollectorService
 
 type DriverCollectorService struct {
-	promsql.DriverCollector
+	*promsql.DriverCollector
 }
 
 // Name implements the rscsrv.Service interface.
@@ -17,15 +18,21 @@ func (srv *DriverCollectorService) Name() string {
 }
 
 func (service *DriverCollectorService) Start() error {
-	collector, err := promsql.Register(promsql.DriverCollectorOpts{
+	// RegisterAs returns the same collector on every call, so restarting the
+	// service does not register a new driver.
+	collector, err := promsql.RegisterAs("postgres-collector", promsql.DriverCollectorOpts{
 		DriverName: "postgres",
 	})
 	if err != nil {
 		return err
 	}
-	service.DriverCollector = *collector
+	service.DriverCollector = collector
 
-	return DefaultPromService.Register(&service.DriverCollector)
+	err = DefaultPromService.Register(service.DriverCollector)
+	if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return nil
+	}
+	return err
 }
 
 // Restart restarts the Prometheus service.
@@ -38,5 +45,8 @@ func (service *DriverCollectorService) Restart() error {
 
 // Stop stops the Prometheus service.
 func (service *DriverCollectorService) Stop() error {
+	if service.DriverCollector != nil {
+		DefaultPromService.Unregister(service.DriverCollector)
+	}
 	return nil
 }
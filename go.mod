@@ -15,4 +15,5 @@ require (
 	github.com/prometheus/common v0.4.1
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/valyala/fasthttp v1.9.0
+	gopkg.in/yaml.v2 v2.2.2
 )
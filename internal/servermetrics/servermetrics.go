@@ -0,0 +1,107 @@
+// Package servermetrics creates the metrics shared by the ServerMetrics of
+// promfasthttp and promhermes.
+package servermetrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Opts configures the metrics created by New. See the ServerMetricsOpts of
+// promfasthttp and promhermes.
+type Opts struct {
+	Namespace       string
+	Registerer      prometheus.Registerer
+	DurationBuckets []float64
+	SizeBuckets     []float64
+}
+
+// Metrics is the standard set of metrics of an HTTP server.
+type Metrics struct {
+	InFlight     prometheus.Gauge
+	Requests     *prometheus.CounterVec
+	Duration     *prometheus.HistogramVec
+	RequestSize  *prometheus.HistogramVec
+	ResponseSize *prometheus.HistogramVec
+}
+
+// New creates the metrics of an HTTP server, partitioned by `labels` and
+// then by the `extra` labels, sorted, and registers them with
+// `opts.Registerer`. The metrics already registered with the same
+// descriptors are reused, so it can be called more than once against the
+// same registerer. It panics if any other registration error happens.
+func New(opts Opts, labels []string, extra []string) *Metrics {
+	if opts.Registerer == nil {
+		opts.Registerer = prometheus.DefaultRegisterer
+	}
+	if opts.DurationBuckets == nil {
+		opts.DurationBuckets = prometheus.DefBuckets
+	}
+	if opts.SizeBuckets == nil {
+		opts.SizeBuckets = prometheus.ExponentialBuckets(100, 10, 7)
+	}
+
+	sorted := append([]string(nil), extra...)
+	sort.Strings(sorted)
+	labelNames := append(append([]string(nil), labels...), sorted...)
+
+	m := &Metrics{
+		InFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "The number of HTTP requests currently being served.",
+		}),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_requests_total",
+			Help:      "The total number of HTTP requests served.",
+		}, labelNames),
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "A histogram of the HTTP request durations.",
+			Buckets:   opts.DurationBuckets,
+		}, labelNames),
+		RequestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_request_size_bytes",
+			Help:      "A histogram of the approximate HTTP request sizes.",
+			Buckets:   opts.SizeBuckets,
+		}, labelNames),
+		ResponseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_response_size_bytes",
+			Help:      "A histogram of the HTTP response body sizes.",
+			Buckets:   opts.SizeBuckets,
+		}, labelNames),
+	}
+
+	m.InFlight = register(opts.Registerer, m.InFlight).(prometheus.Gauge)
+	m.Requests = register(opts.Registerer, m.Requests).(*prometheus.CounterVec)
+	m.Duration = register(opts.Registerer, m.Duration).(*prometheus.HistogramVec)
+	m.RequestSize = register(opts.Registerer, m.RequestSize).(*prometheus.HistogramVec)
+	m.ResponseSize = register(opts.Registerer, m.ResponseSize).(*prometheus.HistogramVec)
+	return m
+}
+
+// register registers `c` with `reg`, returning the collector registered
+// before if there is one.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// Excluded indexes the excluded paths.
+func Excluded(paths []string) map[string]struct{} {
+	excluded := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		excluded[path] = struct{}{}
+	}
+	return excluded
+}
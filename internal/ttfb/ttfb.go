@@ -0,0 +1,107 @@
+// Package ttfb observes the time to the first byte of the responses, for
+// the InstrumentHandlerTimeToWriteHeader middlewares of promfasthttp and
+// promhermes.
+package ttfb
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+)
+
+// streamUserValue is the key of the fasthttp.RequestCtx user value holding
+// the *stream set by SetBodyStreamWriter.
+const streamUserValue = "promhttp.ttfb.stream"
+
+// Observe observes with `obs` the time elapsed since `start` until the
+// response starts being written, once the handler has returned.
+//
+// A response is written by the server right after the handler returns, so
+// the time is observed at once, unless the body is streamed with
+// SetBodyStreamWriter. Then, the time is observed when the stream is first
+// flushed, or at once if it was flushed while the handler was running.
+func Observe(ctx *fasthttp.RequestCtx, obs prometheus.Observer, start time.Time) {
+	s, ok := ctx.UserValue(streamUserValue).(*stream)
+	if !ok || !ctx.Response.IsBodyStream() || !s.await(obs, start) {
+		obs.Observe(time.Since(start).Seconds())
+	}
+}
+
+// SetBodyStreamWriter sets the body stream writer of the response, as
+// `ctx.SetBodyStreamWriter` does, so that the time to its first flush is
+// observed by Observe.
+func SetBodyStreamWriter(ctx *fasthttp.RequestCtx, sw fasthttp.StreamWriter) {
+	s := &stream{}
+	ctx.SetUserValue(streamUserValue, s)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		bw := bufio.NewWriterSize(&flushWriter{w: w, s: s}, w.Size())
+		sw(bw)
+		bw.Flush()
+		// An empty stream is done being written once its writer returns.
+		s.flushed()
+	})
+}
+
+// pending is an observation waiting for the first flush of the stream.
+type pending struct {
+	obs   prometheus.Observer
+	start time.Time
+}
+
+// stream tracks the first flush of a body stream. The stream writer runs
+// in its own goroutine, as soon as the stream is set, so it may be flushed
+// before the handler returns.
+type stream struct {
+	mu      sync.Mutex
+	done    bool
+	pending []pending
+}
+
+// await registers the observation to make at the first flush. It returns
+// false if the stream was already flushed, so the time must be observed at
+// once.
+func (s *stream) await(obs prometheus.Observer, start time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return false
+	}
+	s.pending = append(s.pending, pending{obs: obs, start: start})
+	return true
+}
+
+func (s *stream) flushed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	for _, p := range s.pending {
+		p.obs.Observe(time.Since(p.start).Seconds())
+	}
+	s.pending = nil
+}
+
+// flushWriter writes to the writer of the stream, flushing it, and reports
+// the first write to the stream. It is wrapped by the bufio.Writer given to
+// the stream writer, so it is only written to when that one is flushed or
+// full.
+type flushWriter struct {
+	w *bufio.Writer
+	s *stream
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.w.Flush()
+	}
+	if n > 0 || err != nil {
+		f.s.flushed()
+	}
+	return n, err
+}
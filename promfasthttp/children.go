@@ -0,0 +1,74 @@
+package promfasthttp
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+)
+
+// children caches the children of a vec (or of a set of vecs with the same
+// labels) per childKey, so that once a partition has been seen its requests
+// do not allocate: there is no `prometheus.Labels` to build, nor label
+// values to hash.
+//
+// Since the children are kept, the vecs must not be reset, nor their
+// children deleted. The metrics with extra labels are not cached, as their
+// values are only known as strings returned by the extractors.
+type children struct {
+	labeler *labeler
+	with    func(prometheus.Labels) interface{}
+
+	mu    sync.RWMutex
+	cache map[childKey]interface{}
+}
+
+func newChildren(l *labeler, with func(prometheus.Labels) interface{}) *children {
+	return &children{
+		labeler: l,
+		with:    with,
+		cache:   make(map[childKey]interface{}),
+	}
+}
+
+func newCounterChildren(counter *prometheus.CounterVec, l *labeler) *children {
+	return newChildren(l, func(labels prometheus.Labels) interface{} {
+		return counter.With(labels)
+	})
+}
+
+func newObserverChildren(obs prometheus.ObserverVec, l *labeler) *children {
+	return newChildren(l, func(labels prometheus.Labels) interface{} {
+		return obs.With(labels)
+	})
+}
+
+func (c *children) get(ctx *fasthttp.RequestCtx) interface{} {
+	if len(c.labeler.extra) > 0 {
+		return c.with(c.labeler.labels(ctx))
+	}
+
+	key := c.labeler.key(ctx)
+	c.mu.RLock()
+	child, ok := c.cache[key]
+	c.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if child, ok = c.cache[key]; !ok {
+		child = c.with(c.labeler.keyLabels(key))
+		c.cache[key] = child
+	}
+	return child
+}
+
+func (c *children) counter(ctx *fasthttp.RequestCtx) prometheus.Counter {
+	return c.get(ctx).(prometheus.Counter)
+}
+
+func (c *children) observer(ctx *fasthttp.RequestCtx) prometheus.Observer {
+	return c.get(ctx).(prometheus.Observer)
+}
@@ -0,0 +1,97 @@
+package promfasthttp
+
+import (
+	"bytes"
+
+	"github.com/valyala/fasthttp"
+)
+
+// OtherValue is reported instead of the values missing from the allow-list
+// of a label (see InstrumentOpts.AllowedValues).
+const OtherValue = "other"
+
+// LabelExtractor returns the value of a label for the request. The values
+// must be bounded, as each one creates a new time series.
+type LabelExtractor func(ctx *fasthttp.RequestCtx) string
+
+// InstrumentOpts customizes the labels of the InstrumentHandlerX middlewares.
+type InstrumentOpts struct {
+	// Labels maps the names of extra labels to the functions extracting their
+	// values from the request. They are only used if the metric has such
+	// label, so the same InstrumentOpts can be shared by metrics with
+	// different labels. "code" and "method" cannot be overridden.
+	Labels map[string]LabelExtractor
+
+	// AllowedValues restricts the values of a label, either one of Labels or
+	// "code" and "method", to a known set. The values missing from the set
+	// are reported as OtherValue. It is meant to bound labels whose values
+	// come from the client, such as a tenant header. The non-standard methods
+	// are reported as OtherValue unless they are listed for "method".
+	AllowedValues map[string][]string
+}
+
+// HostLabel is a LabelExtractor reporting the host requested. It must be used
+// with an allow-list unless the server is behind a proxy filtering the hosts.
+func HostLabel(ctx *fasthttp.RequestCtx) string {
+	return string(bytes.ToLower(ctx.Host()))
+}
+
+// HeaderLabel returns a LabelExtractor reporting the value of the request
+// header `name`, such as a tenant id. It must be used with an allow-list
+// unless the values of the header are validated before reaching the server.
+func HeaderLabel(name string) LabelExtractor {
+	return func(ctx *fasthttp.RequestCtx) string {
+		return string(ctx.Request.Header.Peek(name))
+	}
+}
+
+// User agent classes reported by UserAgentClassLabel.
+const (
+	UserAgentBot     = "bot"
+	UserAgentMobile  = "mobile"
+	UserAgentBrowser = "browser"
+	UserAgentTool    = "tool"
+	UserAgentUnknown = "unknown"
+)
+
+// UserAgentClassLabel is a LabelExtractor reporting a coarse class of the
+// `User-Agent` of the request: UserAgentBot, UserAgentMobile,
+// UserAgentBrowser, UserAgentTool (HTTP clients, such as curl) or
+// UserAgentUnknown.
+func UserAgentClassLabel(ctx *fasthttp.RequestCtx) string {
+	return userAgentClass(ctx.Request.Header.UserAgent())
+}
+
+var (
+	botUserAgents    = [][]byte{[]byte("bot"), []byte("crawler"), []byte("spider"), []byte("slurp")}
+	mobileUserAgents = [][]byte{[]byte("mobile"), []byte("android"), []byte("iphone"), []byte("ipad")}
+	toolUserAgents   = [][]byte{[]byte("curl/"), []byte("wget/"), []byte("go-http-client/"), []byte("python-"), []byte("java/"), []byte("okhttp/"), []byte("axios/"), []byte("node-fetch/")}
+)
+
+func userAgentClass(userAgent []byte) string {
+	if len(userAgent) == 0 {
+		return UserAgentUnknown
+	}
+	ua := bytes.ToLower(userAgent)
+	switch {
+	case containsAny(ua, botUserAgents):
+		return UserAgentBot
+	case containsAny(ua, mobileUserAgents):
+		return UserAgentMobile
+	case bytes.HasPrefix(ua, []byte("mozilla/")) || bytes.HasPrefix(ua, []byte("opera/")):
+		return UserAgentBrowser
+	case containsAny(ua, toolUserAgents):
+		return UserAgentTool
+	default:
+		return UserAgentUnknown
+	}
+}
+
+func containsAny(s []byte, subslices [][]byte) bool {
+	for _, sub := range subslices {
+		if bytes.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
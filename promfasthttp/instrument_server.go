@@ -2,6 +2,7 @@ package promfasthttp
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -9,6 +10,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/valyala/fasthttp"
+
+	"github.com/lab259/go-rscsrv-prometheus/internal/ttfb"
 )
 
 // magicString is used for the hacky label test in checkLabels. Remove once fixed.
@@ -29,14 +32,15 @@ func InstrumentHandlerInFlight(g prometheus.Gauge, next fasthttp.RequestHandler)
 
 // InstrumentHandlerDuration is a middleware that wraps the provided
 // fasthttp.RequestHandler to observe the request duration with the provided ObserverVec.
-// The ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the request duration in seconds. Partitioning happens by HTTP
-// status code and/or HTTP method if the respective instance label names are
-// present in the ObserverVec. For unpartitioned observations, use an
-// ObserverVec with zero labels. Note that partitioning of Histograms is
-// expensive and should be used judiciously.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method" and the ones with
+// an extractor in opts (see InstrumentOpts). The function panics otherwise.
+// The Observe method of the Observer in the ObserverVec is called with the
+// request duration in seconds. Partitioning happens by HTTP status code, HTTP method
+// and/or the extra labels if the respective instance label names are present
+// in the ObserverVec. For unpartitioned observations, use an ObserverVec with
+// zero labels. Note that partitioning of Histograms is expensive and should be
+// used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
@@ -44,30 +48,23 @@ func InstrumentHandlerInFlight(g prometheus.Gauge, next fasthttp.RequestHandler)
 //
 // Note that this method is only guaranteed to never observe negative durations
 // if used with Go1.9+.
-func InstrumentHandlerDuration(obs prometheus.ObserverVec, next fasthttp.RequestHandler) fasthttp.RequestHandler {
-	code, method := checkLabels(obs)
-
-	if code {
-		return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-			now := time.Now()
-			next(ctx)
-			obs.With(labels(code, method, string(ctx.Method()), ctx.Response.StatusCode())).Observe(time.Since(now).Seconds())
-		})
-	}
+func InstrumentHandlerDuration(obs prometheus.ObserverVec, next fasthttp.RequestHandler, opts ...InstrumentOpts) fasthttp.RequestHandler {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
 
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		now := time.Now()
 		next(ctx)
-		obs.With(labels(code, method, string(ctx.Method()), 0)).Observe(time.Since(now).Seconds())
+		observers.observer(ctx).Observe(time.Since(now).Seconds())
 	})
 }
 
 // InstrumentHandlerCounter is a middleware that wraps the provided fasthttp.RequestHandler
-// to observe the request result with the provided CounterVec.  The CounterVec
-// must have zero, one, or two non-const non-curried labels. For those, the only
-// allowed label names are "code" and "method". The function panics
-// otherwise. Partitioning of the CounterVec happens by HTTP status code and/or
-// HTTP method if the respective instance label names are present in the
+// to observe the request result with the provided CounterVec. The CounterVec
+// must have zero or more non-const non-curried labels. For those, the only
+// allowed label names are "code", "method" and the ones with an extractor in
+// opts (see InstrumentOpts). The function panics otherwise. Partitioning of
+// the CounterVec happens by HTTP status code, HTTP method and/or the extra
+// labels if the respective instance label names are present in the
 // CounterVec. For unpartitioned counting, use a CounterVec with zero labels.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
@@ -75,108 +72,101 @@ func InstrumentHandlerDuration(obs prometheus.ObserverVec, next fasthttp.Request
 // If the wrapped Handler panics, the Counter is not incremented.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerCounter(counter *prometheus.CounterVec, next fasthttp.RequestHandler) fasthttp.RequestHandler {
-	code, method := checkLabels(counter)
-
-	if code {
-		return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-			next(ctx)
-			counter.With(labels(code, method, string(ctx.Method()), ctx.Response.StatusCode())).Inc()
-		})
-	}
+func InstrumentHandlerCounter(counter *prometheus.CounterVec, next fasthttp.RequestHandler, opts ...InstrumentOpts) fasthttp.RequestHandler {
+	counters := newCounterChildren(counter, newLabeler(counter, opts))
 
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		next(ctx)
-		counter.With(labels(code, method, string(ctx.Method()), 0)).Inc()
+		counters.counter(ctx).Inc()
 	})
 }
 
 // InstrumentHandlerTimeToWriteHeader is a middleware that wraps the provided
-// fasthttp.RequestHandler to observe with the provided ObserverVec the request duration
-// until the response headers are written. The ObserverVec must have zero, one,
-// or two non-const non-curried labels. For those, the only allowed label names
-// are "code" and "method". The function panics otherwise. The Observe method of
-// the Observer in the ObserverVec is called with the request duration in
-// seconds. Partitioning happens by HTTP status code and/or HTTP method if the
-// respective instance label names are present in the ObserverVec. For
-// unpartitioned observations, use an ObserverVec with zero labels. Note that
-// partitioning of Histograms is expensive and should be used judiciously.
+// fasthttp.RequestHandler to observe with the provided ObserverVec the request
+// duration until the response starts being written, that is the time to the
+// first byte. The ObserverVec must have zero or more non-const non-curried
+// labels. For those, the only allowed label names are "code", "method" and
+// the ones with an extractor in opts (see InstrumentOpts). The function panics
+// otherwise. The Observe method of the Observer in the ObserverVec is called
+// with the request duration in seconds. Partitioning happens by HTTP status
+// code, HTTP method and/or the extra labels if the respective instance label
+// names are present in the ObserverVec. For unpartitioned observations, use an
+// ObserverVec with zero labels. Note that partitioning of Histograms is
+// expensive and should be used judiciously.
 //
-// If the wrapped Handler panics before calling WriteHeader, no value is
-// reported.
+// fasthttp writes the response once the wrapped Handler returns, so the time
+// to the first byte is usually the duration of the Handler. But if the body is
+// streamed, the Handler returns before the body is produced. If the stream is
+// set with SetBodyStreamWriter (from this package), the time is observed when
+// the stream is first flushed: it tells the think time of the server apart
+// from the time spent streaming the body to slow clients. Other streams are
+// observed when the Handler returns.
 //
-// Note that this method is only guaranteed to never observe negative durations
-// if used with Go1.9+.
+// If the wrapped Handler does not set a status code, a status code of 200 is assumed.
+//
+// If the wrapped Handler panics, no value is reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-// TODO: try to implement this one using hermes/fasthttp
-// func InstrumentHandlerTimeToWriteHeader(obs prometheus.ObserverVec, next fasthttp.RequestHandler) fasthttp.RequestHandler {
-// 	code, method := checkLabels(obs)
-
-// 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx)  {
-// 		now := time.Now()
-// 		d := newDelegator(w, func(status int) {
-// 			obs.With(labels(code, method, r.Method, status)).Observe(time.Since(now).Seconds())
-// 		})
-// 		next.ServeHTTP(d, r)
-// 	})
-// }
+func InstrumentHandlerTimeToWriteHeader(obs prometheus.ObserverVec, next fasthttp.RequestHandler, opts ...InstrumentOpts) fasthttp.RequestHandler {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		now := time.Now()
+		next(ctx)
+		ttfb.Observe(ctx, observers.observer(ctx), now)
+	})
+}
 
 // InstrumentHandlerRequestSize is a middleware that wraps the provided
-// fasthttp.RequestHandler to observe the request size with the provided ObserverVec.  The
-// ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the request size in bytes. Partitioning happens by HTTP status
-// code and/or HTTP method if the respective instance label names are present in
-// the ObserverVec. For unpartitioned observations, use an ObserverVec with zero
-// labels. Note that partitioning of Histograms is expensive and should be used
-// judiciously.
+// fasthttp.RequestHandler to observe the request size with the provided ObserverVec.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method" and the ones with
+// an extractor in opts (see InstrumentOpts). The function panics otherwise.
+// The Observe method of the Observer in the ObserverVec is called with the
+// request size in bytes. Partitioning happens by HTTP status code, HTTP method
+// and/or the extra labels if the respective instance label names are present
+// in the ObserverVec. For unpartitioned observations, use an ObserverVec with
+// zero labels. Note that partitioning of Histograms is expensive and should be
+// used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
 // If the wrapped Handler panics, no values are reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerRequestSize(obs prometheus.ObserverVec, next fasthttp.RequestHandler) fasthttp.RequestHandler {
-	code, method := checkLabels(obs)
-
-	if code {
-		return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-			next(ctx)
-			size := computeApproximateRequestSize(ctx)
-			obs.With(labels(code, method, string(ctx.Method()), ctx.Response.StatusCode())).Observe(float64(size))
-		})
-	}
+func InstrumentHandlerRequestSize(obs prometheus.ObserverVec, next fasthttp.RequestHandler, opts ...InstrumentOpts) fasthttp.RequestHandler {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
 
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		next(ctx)
 		size := computeApproximateRequestSize(ctx)
-		obs.With(labels(code, method, string(ctx.Method()), 0)).Observe(float64(size))
+		observers.observer(ctx).Observe(float64(size))
 	})
 }
 
 // InstrumentHandlerResponseSize is a middleware that wraps the provided
-// fasthttp.RequestHandler to observe the response size with the provided ObserverVec.  The
-// ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the response size in bytes. Partitioning happens by HTTP status
-// code and/or HTTP method if the respective instance label names are present in
-// the ObserverVec. For unpartitioned observations, use an ObserverVec with zero
-// labels. Note that partitioning of Histograms is expensive and should be used
-// judiciously.
+// fasthttp.RequestHandler to observe the response size with the provided ObserverVec.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method" and the ones with
+// an extractor in opts (see InstrumentOpts). The function panics otherwise.
+// The Observe method of the Observer in the ObserverVec is called with the
+// response size in bytes. Partitioning happens by HTTP status code, HTTP method
+// and/or the extra labels if the respective instance label names are present
+// in the ObserverVec. For unpartitioned observations, use an ObserverVec with
+// zero labels. Note that partitioning of Histograms is expensive and should be
+// used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
 // If the wrapped Handler panics, no values are reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerResponseSize(obs prometheus.ObserverVec, next fasthttp.RequestHandler) fasthttp.RequestHandler {
-	code, method := checkLabels(obs)
+func InstrumentHandlerResponseSize(obs prometheus.ObserverVec, next fasthttp.RequestHandler, opts ...InstrumentOpts) fasthttp.RequestHandler {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		next(ctx)
-		obs.With(labels(code, method, string(ctx.Method()), ctx.Response.StatusCode())).Observe(float64(len(ctx.Response.Body())))
+		observers.observer(ctx).Observe(float64(len(ctx.Response.Body())))
 	})
 }
 
@@ -194,7 +184,49 @@ func parseHeaders(ctx *fasthttp.RequestCtx) map[string][]string {
 
 }
 
-func checkLabels(c prometheus.Collector) (code bool, method bool) {
+// labeler computes the labels of the requests, for the instance labels of a
+// metric.
+type labeler struct {
+	code, method bool
+	extra        []extraLabel
+	allowed      map[string]map[string]struct{}
+}
+
+type extraLabel struct {
+	name    string
+	extract LabelExtractor
+}
+
+// newLabeler checks the instance labels of `c` against the options and
+// returns the labeler of its metrics. It panics if `c` has a label that is
+// neither "code", "method" or one of the extractors of opts.
+func newLabeler(c prometheus.Collector, opts []InstrumentOpts) *labeler {
+	var (
+		extractors = make(map[string]LabelExtractor)
+		allowed    = make(map[string]map[string]struct{})
+	)
+	for _, o := range opts {
+		for name, extract := range o.Labels {
+			if name == "code" || name == "method" {
+				panic(fmt.Sprintf("label %q cannot have an extractor", name))
+			}
+			extractors[name] = extract
+		}
+		for name, values := range o.AllowedValues {
+			set := make(map[string]struct{}, len(values))
+			for _, value := range values {
+				set[value] = struct{}{}
+			}
+			allowed[name] = set
+		}
+	}
+
+	l := &labeler{allowed: allowed}
+	l.code, l.method, l.extra = checkLabels(c, extractors)
+	return l
+}
+
+func checkLabels(c prometheus.Collector, extractors map[string]LabelExtractor) (code bool, method bool, extra []extraLabel) {
 	// TODO(beorn7): Remove this hacky way to check for instance labels
 	// once Descriptors can have their dimensionality queried.
 	var (
@@ -230,7 +262,8 @@ func checkLabels(c prometheus.Collector) (code bool, method bool) {
 	// Write out the metric into a proto message and look at the labels.
 	// If the value is not the magicString, it is a constLabel, which doesn't interest us.
 	// If the label is curried, it doesn't interest us.
-	// In all other cases, only "code" or "method" is allowed.
+	// In all other cases, only "code", "method" or a label with an extractor
+	// is allowed.
 	if err := m.Write(&pm); err != nil {
 		panic("error checking metric for labels")
 	}
@@ -245,7 +278,11 @@ func checkLabels(c prometheus.Collector) (code bool, method bool) {
 		case "method":
 			method = true
 		default:
-			panic("metric partitioned with non-supported labels")
+			extract, ok := extractors[name]
+			if !ok {
+				panic("metric partitioned with non-supported labels")
+			}
+			extra = append(extra, extraLabel{name: name, extract: extract})
 		}
 	}
 	return
@@ -271,47 +308,81 @@ func isLabelCurried(c prometheus.Collector, label string) bool {
 	return true
 }
 
-// emptyLabels is a one-time allocation for non-partitioned metrics to avoid
-// unnecessary allocations on each request.
-var emptyLabels = prometheus.Labels{}
+// childKey identifies a child of a vec by its "code" and "method" labels,
+// sanitized and folded. It is the zero value for the labels the vec does not
+// have.
+type childKey struct {
+	code, method string
+}
 
-func labels(code, method bool, reqMethod string, status int) prometheus.Labels {
-	if !(code || method) {
-		return emptyLabels
+func (l *labeler) key(ctx *fasthttp.RequestCtx) childKey {
+	var key childKey
+	if l.code {
+		key.code = l.fold("code", sanitizeCode(ctx.Response.StatusCode()))
+	}
+	if l.method {
+		key.method = l.fold("method", l.sanitizeMethod(ctx.Method()))
 	}
-	labels := prometheus.Labels{}
+	return key
+}
 
-	if code {
-		labels["code"] = sanitizeCode(status)
+func (l *labeler) keyLabels(key childKey) prometheus.Labels {
+	labels := make(prometheus.Labels, 2+len(l.extra))
+	if l.code {
+		labels["code"] = key.code
 	}
-	if method {
-		labels["method"] = sanitizeMethod(reqMethod)
+	if l.method {
+		labels["method"] = key.method
 	}
-
 	return labels
 }
 
-func computeApproximateRequestSize(ctx *fasthttp.RequestCtx) int {
-	s := 0
-	if ctx.URI() != nil {
-		s += len(ctx.URI().String())
+func (l *labeler) labels(ctx *fasthttp.RequestCtx) prometheus.Labels {
+	labels := l.keyLabels(l.key(ctx))
+	for _, e := range l.extra {
+		labels[e.name] = l.fold(e.name, e.extract(ctx))
 	}
+	return labels
+}
 
-	s += len(ctx.Method())
-	header := parseHeaders(ctx)
-	for name, values := range header {
-		s += len(name)
-		for _, value := range values {
-			s += len(value)
+// fold replaces the values missing from the allow-list of the label by
+// OtherValue.
+func (l *labeler) fold(name, value string) string {
+	if allowed, ok := l.allowed[name]; ok {
+		if _, ok := allowed[value]; !ok {
+			return OtherValue
 		}
 	}
+	return value
+}
+
+// computeApproximateRequestSize measures the request line, the headers and
+// the body. The headers are measured from their raw bytes, as received by the
+// server, so nothing is allocated.
+func computeApproximateRequestSize(ctx *fasthttp.RequestCtx) int {
+	s := len(ctx.Method()) + len(ctx.RequestURI())
+
+	if raw := ctx.Request.Header.RawHeaders(); len(raw) > 0 {
+		s += len(raw)
+	} else {
+		// The request was not parsed by the server (e.g. it was built by a
+		// test), so there are no raw headers.
+		ctx.Request.Header.VisitAll(func(name, value []byte) {
+			s += len(name) + len(value)
+		})
+	}
 
-	s += int(len(ctx.Request.Body()))
+	s += len(ctx.Request.Body())
 	return s
 }
 
-func sanitizeMethod(m string) string {
-	switch m {
+// sanitizeMethod returns the lower-cased method of the request. The
+// non-standard methods are reported as OtherValue, as the clients can send
+// any, unless they are listed in the allow-list of the "method" label.
+func (l *labeler) sanitizeMethod(m []byte) string {
+	// The conversion of `m` does not allocate, as the compiler only uses it
+	// for the comparisons.
+	switch string(m) {
 	case "GET", "get":
 		return "get"
 	case "PUT", "put":
@@ -328,9 +399,16 @@ func sanitizeMethod(m string) string {
 		return "options"
 	case "NOTIFY", "notify":
 		return "notify"
-	default:
-		return strings.ToLower(m)
+	case "PATCH", "patch":
+		return "patch"
+	case "TRACE", "trace":
+		return "trace"
+	}
+	if _, ok := l.allowed["method"]; ok {
+		// fold reports the methods missing from the allow-list.
+		return strings.ToLower(string(m))
 	}
+	return OtherValue
 }
 
 // If the wrapped fasthttp.RequestHandler has not set a status code, i.e. the value is
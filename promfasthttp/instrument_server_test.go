@@ -1,15 +1,37 @@
 package promfasthttp
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"log"
+	"strings"
+	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/valyala/fasthttp"
 )
 
+// parseRequestCtx creates a fasthttp.RequestCtx from a raw request, as the
+// server does.
+func parseRequestCtx(raw string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	if err := ctx.Request.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		panic(err)
+	}
+	return ctx
+}
+
+const benchmarkRequest = "GET /users/10?fields=name HTTP/1.1\r\n" +
+	"Host: api.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64) Firefox/68.0\r\n" +
+	"Accept: application/json\r\n" +
+	"\r\n"
+
 func createRequestCtx(method, path string) *fasthttp.RequestCtx {
 	ctx := &fasthttp.RequestCtx{}
 	ctx.Request.Header.SetMethod(method)
@@ -23,6 +45,7 @@ var _ = Describe("Instrument Server", func() {
 			varLabels     []string
 			constLabels   []string
 			curriedLabels []string
+			extractors    []string
 			ok            bool
 		}{
 			"empty": {
@@ -91,6 +114,34 @@ var _ = Describe("Instrument Server", func() {
 				curriedLabels: []string{"method"},
 				ok:            false,
 			},
+			"extra label with an extractor": {
+				varLabels:     []string{"code", "tenant"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant"},
+				ok:            true,
+			},
+			"extractor without label": {
+				varLabels:     []string{"method"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant", "host"},
+				ok:            true,
+			},
+			"extra label without an extractor": {
+				varLabels:     []string{"code", "tenant", "host"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant"},
+				ok:            false,
+			},
+			"extractor overriding code": {
+				varLabels:     []string{"code"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"code"},
+				ok:            false,
+			},
 		}
 
 		for name, sc := range scenarios {
@@ -119,6 +170,10 @@ var _ = Describe("Instrument Server", func() {
 					c = c.MustCurryWith(prometheus.Labels{l: "dummy"})
 					o = o.MustCurryWith(prometheus.Labels{l: "dummy"})
 				}
+				opts := InstrumentOpts{Labels: map[string]LabelExtractor{}}
+				for _, l := range sc.extractors {
+					opts.Labels[l] = HeaderLabel(l)
+				}
 
 				func() {
 					defer func() {
@@ -130,7 +185,7 @@ var _ = Describe("Instrument Server", func() {
 							Fail("expected panic")
 						}
 					}()
-					InstrumentHandlerCounter(c, nil)
+					InstrumentHandlerCounter(c, nil, opts)
 				}()
 				func() {
 					defer func() {
@@ -142,26 +197,34 @@ var _ = Describe("Instrument Server", func() {
 							Fail("expected panic")
 						}
 					}()
-					InstrumentHandlerDuration(o, nil)
+					InstrumentHandlerDuration(o, nil, opts)
 				}()
 				if sc.ok {
-					// Test if wantCode and wantMethod were detected correctly.
-					var wantCode, wantMethod bool
+					// Test if wantCode, wantMethod and wantExtra were detected
+					// correctly.
+					var (
+						wantCode, wantMethod bool
+						wantExtra            []string
+					)
 					for _, l := range sc.varLabels {
-						if l == "code" {
+						switch l {
+						case "code":
 							wantCode = true
-						}
-						if l == "method" {
+						case "method":
 							wantMethod = true
+						default:
+							wantExtra = append(wantExtra, l)
 						}
 					}
-					gotCode, gotMethod := checkLabels(c)
+					gotCode, gotMethod, gotExtra := checkLabels(c, opts.Labels)
 					Expect(gotCode).To(Equal(wantCode))
 					Expect(gotMethod).To(Equal(wantMethod))
+					Expect(extraLabelNames(gotExtra)).To(ConsistOf(wantExtra))
 
-					gotCode, gotMethod = checkLabels(o)
+					gotCode, gotMethod, gotExtra = checkLabels(o, opts.Labels)
 					Expect(gotCode).To(Equal(wantCode))
 					Expect(gotMethod).To(Equal(wantMethod))
+					Expect(extraLabelNames(gotExtra)).To(ConsistOf(wantExtra))
 				}
 			})
 		}
@@ -221,18 +284,282 @@ var _ = Describe("Instrument Server", func() {
 		chain := InstrumentHandlerInFlight(inFlightGauge,
 			InstrumentHandlerCounter(counter,
 				InstrumentHandlerDuration(histVec,
-					// InstrumentHandlerTimeToWriteHeader(writeHeaderVec,
-					InstrumentHandlerResponseSize(responseSize, handler),
-					// ),
+					InstrumentHandlerTimeToWriteHeader(writeHeaderVec,
+						InstrumentHandlerResponseSize(responseSize, handler),
+					),
 				),
 			),
 		)
 
 		ctx := createRequestCtx("GET", "/")
 		chain(ctx)
+
+		var metric dto.Metric
+		Expect(writeHeaderVec.WithLabelValues().(prometheus.Histogram).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	When("observing the time to the first byte", func() {
+		var histogram *prometheus.HistogramVec
+
+		BeforeEach(func() {
+			histogram = prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name: "time_to_first_byte_seconds",
+					Help: "A histogram of the time to the first byte.",
+				},
+				[]string{"code"},
+			)
+		})
+
+		observed := func() (uint64, float64) {
+			var metric dto.Metric
+			Expect(histogram.WithLabelValues("200").(prometheus.Histogram).Write(&metric)).To(Succeed())
+			return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+		}
+
+		// writeResponse writes the response as the server does, once the
+		// handler has returned.
+		writeResponse := func(ctx *fasthttp.RequestCtx) string {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			Expect(ctx.Response.Write(w)).To(Succeed())
+			Expect(w.Flush()).To(Succeed())
+			return buf.String()
+		}
+
+		It("should observe when the handler returns", func() {
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				ctx.WriteString("OK")
+			})
+			handler(createRequestCtx("GET", "/"))
+
+			count, _ := observed()
+			Expect(count).To(BeEquivalentTo(1))
+		})
+
+		It("should observe when a stream is first flushed", func() {
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				SetBodyStreamWriter(ctx, func(w *bufio.Writer) {
+					time.Sleep(50 * time.Millisecond)
+					w.WriteString("first")
+					w.Flush()
+					time.Sleep(200 * time.Millisecond)
+					w.WriteString(" second")
+				})
+			})
+			ctx := createRequestCtx("GET", "/")
+			handler(ctx)
+
+			count, _ := observed()
+			Expect(count).To(BeZero())
+
+			response := writeResponse(ctx)
+			Expect(response).To(ContainSubstring("first"))
+			Expect(response).To(ContainSubstring(" second"))
+			count, sum := observed()
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(sum).To(BeNumerically(">=", 0.05))
+			Expect(sum).To(BeNumerically("<", 0.25))
+		})
+
+		It("should observe when an empty stream is done", func() {
+			done := make(chan struct{})
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				SetBodyStreamWriter(ctx, func(w *bufio.Writer) {
+					<-done
+				})
+			})
+			ctx := createRequestCtx("GET", "/")
+			handler(ctx)
+
+			count, _ := observed()
+			Expect(count).To(BeZero())
+
+			close(done)
+			Expect(writeResponse(ctx)).To(HaveSuffix("\r\n\r\n0\r\n\r\n"))
+			count, _ = observed()
+			Expect(count).To(BeEquivalentTo(1))
+		})
+
+		It("should observe when the handler returns if the stream was flushed before", func() {
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				flushed := make(chan struct{})
+				SetBodyStreamWriter(ctx, func(w *bufio.Writer) {
+					w.WriteString("OK")
+					w.Flush()
+					close(flushed)
+				})
+				<-flushed
+				time.Sleep(50 * time.Millisecond)
+			})
+			ctx := createRequestCtx("GET", "/")
+			handler(ctx)
+
+			count, sum := observed()
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(sum).To(BeNumerically(">=", 0.05))
+			Expect(writeResponse(ctx)).To(ContainSubstring("OK"))
+		})
+
+		It("should observe when the handler returns for streams set directly", func() {
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					time.Sleep(50 * time.Millisecond)
+					w.WriteString("OK")
+				})
+			})
+			ctx := createRequestCtx("GET", "/")
+			handler(ctx)
+
+			count, sum := observed()
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(sum).To(BeNumerically("<", 0.05))
+			Expect(writeResponse(ctx)).To(ContainSubstring("OK"))
+		})
+
+		It("should observe when the handler returns for the streams of files", func() {
+			handler := InstrumentHandlerTimeToWriteHeader(histogram, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyStream(bytes.NewReader([]byte("OK")), 2)
+			})
+			ctx := createRequestCtx("GET", "/")
+			handler(ctx)
+
+			count, _ := observed()
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(writeResponse(ctx)).To(HaveSuffix("\r\n\r\nOK"))
+		})
+	})
+
+	When("using extra labels", func() {
+		var (
+			counter *prometheus.CounterVec
+			handler fasthttp.RequestHandler
+		)
+
+		BeforeEach(func() {
+			counter = prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "api_requests_total",
+					Help: "A counter for requests to the wrapped handler.",
+				},
+				[]string{"code", "tenant", "user_agent_class"},
+			)
+			handler = InstrumentHandlerCounter(counter, func(ctx *fasthttp.RequestCtx) {
+				ctx.WriteString("OK")
+			}, InstrumentOpts{
+				Labels: map[string]LabelExtractor{
+					"tenant":           HeaderLabel("X-Tenant"),
+					"user_agent_class": UserAgentClassLabel,
+				},
+				AllowedValues: map[string][]string{
+					"tenant": {"acme", "globex"},
+				},
+			})
+		})
+
+		request := func(tenant, userAgent string) {
+			ctx := createRequestCtx("GET", "/")
+			ctx.Request.Header.Set("X-Tenant", tenant)
+			ctx.Request.Header.SetUserAgent(userAgent)
+			handler(ctx)
+		}
+
+		count := func(code, tenant, userAgentClass string) float64 {
+			var metric dto.Metric
+			Expect(counter.WithLabelValues(code, tenant, userAgentClass).Write(&metric)).To(Succeed())
+			return metric.GetCounter().GetValue()
+		}
+
+		series := func() int {
+			ch := make(chan prometheus.Metric, 10)
+			counter.Collect(ch)
+			close(ch)
+			return len(ch)
+		}
+
+		It("should partition by the extracted values", func() {
+			request("acme", "curl/7.64.1")
+			request("acme", "curl/7.64.1")
+			request("globex", "Mozilla/5.0 (X11; Linux x86_64) Firefox/68.0")
+
+			Expect(series()).To(Equal(2))
+			Expect(count("200", "acme", UserAgentTool)).To(BeEquivalentTo(2))
+			Expect(count("200", "globex", UserAgentBrowser)).To(BeEquivalentTo(1))
+		})
+
+		It("should fold the values missing from the allow-list", func() {
+			request("initech", "Googlebot/2.1")
+			request("umbrella", "Googlebot/2.1")
+
+			Expect(series()).To(Equal(1))
+			Expect(count("200", OtherValue, UserAgentBot)).To(BeEquivalentTo(2))
+		})
+	})
+
+	It("should report the non-standard methods as other, unless allowed", func() {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"method"})
+
+		l := newLabeler(counter, nil)
+		Expect(l.sanitizeMethod([]byte("PATCH"))).To(Equal("patch"))
+		Expect(l.sanitizeMethod([]byte("PROPFIND"))).To(Equal(OtherValue))
+
+		l = newLabeler(counter, []InstrumentOpts{{
+			AllowedValues: map[string][]string{"method": {"get", "propfind"}},
+		}})
+		Expect(l.fold("method", l.sanitizeMethod([]byte("PROPFIND")))).To(Equal("propfind"))
+		Expect(l.fold("method", l.sanitizeMethod([]byte("MKCOL")))).To(Equal(OtherValue))
+	})
+
+	It("should measure the request size from the raw headers", func() {
+		ctx := parseRequestCtx(benchmarkRequest)
+		// The method, the request URI and the raw headers, up to the blank
+		// line.
+		requestLine := len("GET") + len("/users/10?fields=name")
+		headers := len(benchmarkRequest) - strings.Index(benchmarkRequest, "Host:")
+		Expect(computeApproximateRequestSize(ctx)).To(Equal(requestLine + headers))
+	})
+
+	It("should not allocate once the partitions are known", func() {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"code", "method"})
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method"})
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "g", Help: "g help"})
+
+		chain := InstrumentHandlerInFlight(gauge,
+			InstrumentHandlerCounter(counter,
+				InstrumentHandlerDuration(histogram,
+					InstrumentHandlerRequestSize(histogram,
+						InstrumentHandlerResponseSize(histogram, benchmarkHandler),
+					),
+				),
+			),
+		)
+
+		ctx := parseRequestCtx(benchmarkRequest)
+		chain(ctx)
+		Expect(testing.AllocsPerRun(100, func() {
+			chain(ctx)
+		})).To(BeZero())
+	})
+
+	It("should classify user agents", func() {
+		Expect(userAgentClass(nil)).To(Equal(UserAgentUnknown))
+		Expect(userAgentClass([]byte("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"))).To(Equal(UserAgentBot))
+		Expect(userAgentClass([]byte("Mozilla/5.0 (iPhone; CPU iPhone OS 12_2 like Mac OS X) Mobile/15E148"))).To(Equal(UserAgentMobile))
+		Expect(userAgentClass([]byte("Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/75.0.3770.142"))).To(Equal(UserAgentBrowser))
+		Expect(userAgentClass([]byte("Go-http-client/1.1"))).To(Equal(UserAgentTool))
+		Expect(userAgentClass([]byte("my-scraper"))).To(Equal(UserAgentUnknown))
 	})
 })
 
+func extraLabelNames(extra []extraLabel) []string {
+	names := make([]string, 0, len(extra))
+	for _, e := range extra {
+		names = append(names, e.name)
+	}
+	return names
+}
+
 func ExampleInstrumentHandlerDuration() {
 	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "in_flight_requests",
@@ -314,3 +641,36 @@ func ExampleInstrumentHandlerDuration() {
 		log.Fatal(err)
 	}
 }
+
+func benchmarkHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.SetBodyString("OK")
+}
+
+func benchmarkInstrumentHandler(b *testing.B, handler fasthttp.RequestHandler) {
+	ctx := parseRequestCtx(benchmarkRequest)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(ctx)
+	}
+}
+
+func BenchmarkInstrumentHandlerCounter(b *testing.B) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"code", "method"})
+	benchmarkInstrumentHandler(b, InstrumentHandlerCounter(counter, benchmarkHandler))
+}
+
+func BenchmarkInstrumentHandlerDuration(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method"})
+	benchmarkInstrumentHandler(b, InstrumentHandlerDuration(histogram, benchmarkHandler))
+}
+
+func BenchmarkInstrumentHandlerRequestSize(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method"})
+	benchmarkInstrumentHandler(b, InstrumentHandlerRequestSize(histogram, benchmarkHandler))
+}
+
+func BenchmarkInstrumentHandlerResponseSize(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method"})
+	benchmarkInstrumentHandler(b, InstrumentHandlerResponseSize(histogram, benchmarkHandler))
+}
@@ -0,0 +1,132 @@
+package promfasthttp
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/lab259/go-rscsrv-prometheus/internal/servermetrics"
+)
+
+// ServerMetricsOpts configures the metrics created by NewServerMetrics.
+type ServerMetricsOpts struct {
+	// Namespace prefixes the name of the metrics (e.g. `myapp` reports
+	// `myapp_http_requests_total`).
+	Namespace string
+	// Registerer registers the metrics, such as a *promsrv.Service. If nil,
+	// prometheus.DefaultRegisterer is used.
+	Registerer prometheus.Registerer
+	// DurationBuckets defines the buckets of the request duration histogram.
+	// If nil, prometheus.DefBuckets is used.
+	DurationBuckets []float64
+	// SizeBuckets defines the buckets of the request and response size
+	// histograms. If nil, exponential buckets from 100B to 100MB are used.
+	SizeBuckets []float64
+	// ExcludedPaths lists the paths that are not instrumented, such as the
+	// metrics or the health check endpoints. They must match exactly.
+	ExcludedPaths []string
+	// Instrument adds extra labels to the metrics, besides "code" and
+	// "method" (see InstrumentOpts).
+	Instrument InstrumentOpts
+}
+
+// ServerMetrics is the standard set of metrics of an HTTP server: requests
+// in flight, request count, duration, request and response sizes,
+// partitioned by HTTP status code, HTTP method and the extra labels of
+// ServerMetricsOpts.Instrument.
+type ServerMetrics struct {
+	InFlight     prometheus.Gauge
+	Requests     *prometheus.CounterVec
+	Duration     *prometheus.HistogramVec
+	RequestSize  *prometheus.HistogramVec
+	ResponseSize *prometheus.HistogramVec
+
+	children *children
+	excluded map[string]struct{}
+}
+
+// serverChildren are the children of the vecs of ServerMetrics for a
+// partition.
+type serverChildren struct {
+	requests     prometheus.Counter
+	duration     prometheus.Observer
+	requestSize  prometheus.Observer
+	responseSize prometheus.Observer
+}
+
+// NewServerMetrics creates the metrics of an HTTP server and registers them
+// with `opts.Registerer`. The metrics already registered by a previous call
+// with the same options are reused, so the ServerMetrics can be created again
+// (e.g. when a service restarts). It panics if the registration fails
+// otherwise, such as when metrics with the same names but other labels are
+// already registered.
+//
+// Example:
+//
+//	metrics := promfasthttp.NewServerMetrics(promfasthttp.ServerMetricsOpts{
+//		Namespace:     "myapp",
+//		Registerer:    &promService,
+//		ExcludedPaths: []string{"/metrics"},
+//	})
+//	fasthttp.ListenAndServe(":8080", metrics.Handler(handler))
+func NewServerMetrics(opts ServerMetricsOpts) *ServerMetrics {
+	extra := make([]string, 0, len(opts.Instrument.Labels))
+	for name := range opts.Instrument.Labels {
+		extra = append(extra, name)
+	}
+	metrics := servermetrics.New(servermetrics.Opts{
+		Namespace:       opts.Namespace,
+		Registerer:      opts.Registerer,
+		DurationBuckets: opts.DurationBuckets,
+		SizeBuckets:     opts.SizeBuckets,
+	}, []string{"code", "method"}, extra)
+
+	m := &ServerMetrics{
+		InFlight:     metrics.InFlight,
+		Requests:     metrics.Requests,
+		Duration:     metrics.Duration,
+		RequestSize:  metrics.RequestSize,
+		ResponseSize: metrics.ResponseSize,
+		excluded:     servermetrics.Excluded(opts.ExcludedPaths),
+	}
+	// All the vecs share the same labels, so their children are looked up
+	// only once per request.
+	m.children = newChildren(newLabeler(m.Requests, []InstrumentOpts{opts.Instrument}), func(labels prometheus.Labels) interface{} {
+		return &serverChildren{
+			requests:     m.Requests.With(labels),
+			duration:     m.Duration.With(labels),
+			requestSize:  m.RequestSize.With(labels),
+			responseSize: m.ResponseSize.With(labels),
+		}
+	})
+	return m
+}
+
+// Handler wraps `next` to record the metrics of its requests, except the
+// ones of the excluded paths.
+//
+// If the wrapped Handler does not set a status code, a status code of 200 is assumed.
+//
+// If the wrapped Handler panics, only the requests in flight are reported.
+func (m *ServerMetrics) Handler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		if _, ok := m.excluded[string(ctx.Path())]; ok {
+			next(ctx)
+			return
+		}
+
+		m.InFlight.Inc()
+		defer m.InFlight.Dec()
+
+		now := time.Now()
+		next(ctx)
+		elapsed := time.Since(now).Seconds()
+
+		children := m.children.get(ctx).(*serverChildren)
+		children.requests.Inc()
+		children.duration.Observe(elapsed)
+		children.requestSize.Observe(float64(computeApproximateRequestSize(ctx)))
+		children.responseSize.Observe(float64(len(ctx.Response.Body())))
+	})
+}
@@ -0,0 +1,133 @@
+package promfasthttp
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/valyala/fasthttp"
+
+	promsrv "github.com/lab259/go-rscsrv-prometheus"
+)
+
+var _ = Describe("Server Metrics", func() {
+	var (
+		service *promsrv.Service
+		metrics *ServerMetrics
+		handler fasthttp.RequestHandler
+	)
+
+	BeforeEach(func() {
+		service = &promsrv.Service{}
+		metrics = NewServerMetrics(ServerMetricsOpts{
+			Namespace:     "myapp",
+			Registerer:    service,
+			ExcludedPaths: []string{"/metrics"},
+			Instrument: InstrumentOpts{
+				Labels: map[string]LabelExtractor{
+					"tenant": HeaderLabel("X-Tenant"),
+				},
+				AllowedValues: map[string][]string{
+					"tenant": {"acme"},
+				},
+			},
+		})
+		handler = metrics.Handler(func(ctx *fasthttp.RequestCtx) {
+			if string(ctx.Path()) == "/missing" {
+				ctx.SetStatusCode(fasthttp.StatusNotFound)
+			}
+			ctx.WriteString("OK")
+		})
+	})
+
+	families := func() map[string]*dto.MetricFamily {
+		mfs, err := service.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		byName := make(map[string]*dto.MetricFamily, len(mfs))
+		for _, mf := range mfs {
+			byName[mf.GetName()] = mf
+		}
+		return byName
+	}
+
+	It("should register the metrics", func() {
+		handler(createRequestCtx("GET", "/users"))
+
+		Expect(families()).To(HaveLen(5))
+		Expect(families()).To(HaveKey("myapp_http_requests_in_flight"))
+		Expect(families()).To(HaveKey("myapp_http_requests_total"))
+		Expect(families()).To(HaveKey("myapp_http_request_duration_seconds"))
+		Expect(families()).To(HaveKey("myapp_http_request_size_bytes"))
+		Expect(families()).To(HaveKey("myapp_http_response_size_bytes"))
+	})
+
+	It("should reuse the metrics already registered", func() {
+		again := NewServerMetrics(ServerMetricsOpts{
+			Namespace:  "myapp",
+			Registerer: service,
+			Instrument: InstrumentOpts{
+				Labels: map[string]LabelExtractor{
+					"tenant": HeaderLabel("X-Tenant"),
+				},
+			},
+		})
+		Expect(again.Requests).To(BeIdenticalTo(metrics.Requests))
+		Expect(again.InFlight).To(BeIdenticalTo(metrics.InFlight))
+	})
+
+	It("should panic if metrics with other labels are registered", func() {
+		Expect(func() {
+			NewServerMetrics(ServerMetricsOpts{Namespace: "myapp", Registerer: service})
+		}).To(Panic())
+	})
+
+	It("should record the requests", func() {
+		ctx := createRequestCtx("GET", "/users")
+		ctx.Request.Header.Set("X-Tenant", "acme")
+		handler(ctx)
+		handler(createRequestCtx("POST", "/missing"))
+
+		mfs := families()
+		requests := mfs["myapp_http_requests_total"].GetMetric()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].GetLabel()).To(HaveLen(3))
+		Expect(requests[0].GetLabel()[0].GetValue()).To(Equal("200"))
+		Expect(requests[0].GetLabel()[1].GetValue()).To(Equal("get"))
+		Expect(requests[0].GetLabel()[2].GetValue()).To(Equal("acme"))
+		Expect(requests[1].GetLabel()[0].GetValue()).To(Equal("404"))
+		Expect(requests[1].GetLabel()[1].GetValue()).To(Equal("post"))
+		Expect(requests[1].GetLabel()[2].GetValue()).To(Equal(OtherValue))
+
+		duration := mfs["myapp_http_request_duration_seconds"].GetMetric()
+		Expect(duration).To(HaveLen(2))
+		Expect(duration[0].GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+
+		responseSize := mfs["myapp_http_response_size_bytes"].GetMetric()
+		Expect(responseSize[0].GetHistogram().GetSampleSum()).To(BeEquivalentTo(2))
+
+		Expect(mfs["myapp_http_requests_in_flight"].GetMetric()[0].GetGauge().GetValue()).To(BeZero())
+	})
+
+	It("should not allocate once the partitions are known", func() {
+		handler := NewServerMetrics(ServerMetricsOpts{Registerer: service}).Handler(benchmarkHandler)
+		ctx := parseRequestCtx(benchmarkRequest)
+		handler(ctx)
+		Expect(testing.AllocsPerRun(100, func() {
+			handler(ctx)
+		})).To(BeZero())
+	})
+
+	It("should not record the excluded paths", func() {
+		ctx := createRequestCtx("GET", "/metrics")
+		handler(ctx)
+
+		Expect(string(ctx.Response.Body())).To(Equal("OK"))
+		Expect(families()["myapp_http_requests_total"].GetMetric()).To(BeEmpty())
+	})
+})
+
+func BenchmarkServerMetrics(b *testing.B) {
+	metrics := NewServerMetrics(ServerMetricsOpts{Registerer: &promsrv.Service{}})
+	benchmarkInstrumentHandler(b, metrics.Handler(benchmarkHandler))
+}
@@ -0,0 +1,46 @@
+package promfasthttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+	"github.com/valyala/fasthttp"
+)
+
+// StatementsHandler returns a fasthttp.RequestHandler that renders, as JSON,
+// the statements tracked by the given promsql.StatementTracker.
+//
+// The `sort` query parameter (`total`, `mean`, `max` or `count`) defines the
+// order of the statements and `limit` how many of them are rendered. A
+// DELETE request resets the tracker.
+func StatementsHandler(tracker *promsql.StatementTracker) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		statements := []promsql.StatementStats{}
+		if ctx.IsDelete() {
+			tracker.Reset()
+		} else {
+			args := ctx.QueryArgs()
+			order, err := promsql.ParseStatementOrder(string(args.Peek("sort")))
+			if err != nil {
+				ctx.Error(err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			limit := 0
+			if s := args.Peek("limit"); len(s) > 0 {
+				if limit, err = strconv.Atoi(string(s)); err != nil {
+					ctx.Error("Invalid limit.", http.StatusBadRequest)
+					return
+				}
+			}
+			statements = tracker.Top(limit, order)
+		}
+
+		ctx.SetContentType("application/json")
+		if err := json.NewEncoder(ctx).Encode(statements); err != nil {
+			httpError(ctx, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package promfasthttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+var _ = Describe("Statements Handler", func() {
+	var tracker *promsql.StatementTracker
+
+	BeforeEach(func() {
+		tracker = promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT a FROM b", 3*time.Second, nil)
+	})
+
+	It("should render the statements as JSON", func() {
+		ctx := createRequestCtx("GET", "/statements")
+		ctx.Request.URI().SetQueryString("limit=1")
+		StatementsHandler(tracker)(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+		Expect(string(ctx.Response.Header.ContentType())).To(Equal("application/json"))
+
+		var statements []map[string]interface{}
+		Expect(json.Unmarshal(ctx.Response.Body(), &statements)).To(Succeed())
+		Expect(statements).To(HaveLen(1))
+		Expect(statements[0]).To(HaveKeyWithValue("fingerprint", "select a from b"))
+		Expect(statements[0]).To(HaveKeyWithValue("total_seconds", BeEquivalentTo(3)))
+	})
+
+	It("should reject invalid limits", func() {
+		ctx := createRequestCtx("GET", "/statements")
+		ctx.Request.URI().SetQueryString("limit=all")
+		StatementsHandler(tracker)(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should reset the tracker", func() {
+		ctx := createRequestCtx("DELETE", "/statements")
+		StatementsHandler(tracker)(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+		Expect(string(ctx.Response.Body())).To(Equal("[]\n"))
+		Expect(tracker.Top(0, promsql.OrderByTotalDuration)).To(BeEmpty())
+	})
+})
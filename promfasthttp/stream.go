@@ -0,0 +1,15 @@
+package promfasthttp
+
+import (
+	"github.com/valyala/fasthttp"
+
+	"github.com/lab259/go-rscsrv-prometheus/internal/ttfb"
+)
+
+// SetBodyStreamWriter sets the body stream writer of the response, as
+// `ctx.SetBodyStreamWriter` does, so that InstrumentHandlerTimeToWriteHeader
+// observes the time to the first flush of the stream, instead of the time the
+// handler returns.
+func SetBodyStreamWriter(ctx *fasthttp.RequestCtx, sw fasthttp.StreamWriter) {
+	ttfb.SetBodyStreamWriter(ctx, sw)
+}
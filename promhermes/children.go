@@ -0,0 +1,88 @@
+package promhermes
+
+import (
+	"sync"
+
+	"github.com/lab259/hermes"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// children caches the children of a vec (or of a set of vecs with the same
+// labels) per childKey and route pattern, so that once a partition has been
+// seen its requests do not allocate: there is no `prometheus.Labels` to
+// build, nor label values to hash.
+//
+// Since the children are kept, the vecs must not be reset, nor their
+// children deleted. The metrics with extra labels are not cached, as their
+// values are only known as strings returned by the extractors.
+type children struct {
+	labeler *labeler
+	with    func(prometheus.Labels) interface{}
+
+	mu sync.RWMutex
+	// cache is indexed by the route pattern in a second level. The pattern
+	// is empty if there is no "route" label.
+	cache map[childKey]map[string]interface{}
+}
+
+func newChildren(l *labeler, with func(prometheus.Labels) interface{}) *children {
+	return &children{
+		labeler: l,
+		with:    with,
+		cache:   make(map[childKey]map[string]interface{}),
+	}
+}
+
+func newCounterChildren(counter *prometheus.CounterVec, l *labeler) *children {
+	return newChildren(l, func(labels prometheus.Labels) interface{} {
+		return counter.With(labels)
+	})
+}
+
+func newObserverChildren(obs prometheus.ObserverVec, l *labeler) *children {
+	return newChildren(l, func(labels prometheus.Labels) interface{} {
+		return obs.With(labels)
+	})
+}
+
+func (c *children) get(req hermes.Request) interface{} {
+	if len(c.labeler.extra) > 0 {
+		return c.with(c.labeler.labels(req))
+	}
+
+	var (
+		key   = c.labeler.key(req)
+		route string
+	)
+	if c.labeler.route {
+		route = c.labeler.fold("route", RoutePattern(req))
+	}
+
+	c.mu.RLock()
+	child, ok := c.cache[key][route]
+	c.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	routes, ok := c.cache[key]
+	if !ok {
+		routes = make(map[string]interface{})
+		c.cache[key] = routes
+	}
+	if child, ok = routes[route]; !ok {
+		child = c.with(c.labeler.keyLabels(key, route))
+		routes[route] = child
+	}
+	return child
+}
+
+func (c *children) counter(req hermes.Request) prometheus.Counter {
+	return c.get(req).(prometheus.Counter)
+}
+
+func (c *children) observer(req hermes.Request) prometheus.Observer {
+	return c.get(req).(prometheus.Observer)
+}
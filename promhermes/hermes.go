@@ -11,6 +11,10 @@
 // via middleware. Middleware wrappers follow the naming scheme
 // InstrumentHandlerX, where X describes the intended use of the middleware.
 // See each function's doc comment for specific details.
+//
+// The middlewares keep the children of the metric vecs they were given, so
+// that instrumenting a request does not allocate. Hence, those vecs must not
+// be reset, nor have their children deleted.
 package promhermes
 
 import (
@@ -2,6 +2,7 @@ package promhermes
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -10,6 +11,8 @@ import (
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/lab259/go-rscsrv-prometheus/internal/ttfb"
 )
 
 // magicString is used for the hacky label test in checkLabels. Remove once fixed.
@@ -21,23 +24,30 @@ const magicString = "zZgWfBxLqvG8kc8IMv3POi2Bb0tZI3vAnBx+gBaFi9FyPzB/CzKUer1yufD
 //
 // See the example for InstrumentHandlerDuration for example usage.
 func InstrumentHandlerInFlight(g prometheus.Gauge, next hermes.Handler) hermes.Handler {
-	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+	return wrapHandler(InstrumentMiddlewareInFlight(g), next)
+}
+
+// InstrumentMiddlewareInFlight is the hermes.Middleware version of
+// InstrumentHandlerInFlight, to be used with `router.Use`.
+func InstrumentMiddlewareInFlight(g prometheus.Gauge) hermes.Middleware {
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
 		g.Inc()
 		defer g.Dec()
 		return next(req, res)
-	})
+	}
 }
 
 // InstrumentHandlerDuration is a middleware that wraps the provided
 // hermes.Handler to observe the request duration with the provided ObserverVec.
-// The ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the request duration in seconds. Partitioning happens by HTTP
-// status code and/or HTTP method if the respective instance label names are
-// present in the ObserverVec. For unpartitioned observations, use an
-// ObserverVec with zero labels. Note that partitioning of Histograms is
-// expensive and should be used judiciously.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method", "route" and the
+// ones with an extractor in opts (see InstrumentOpts). The function panics
+// otherwise. The Observe method of the Observer in the ObserverVec is called
+// with the request duration in seconds. Partitioning happens by HTTP status code,
+// HTTP method, route pattern (see RoutePattern) and/or the extra labels if the respective
+// instance label names are present in the ObserverVec. For unpartitioned
+// observations, use an ObserverVec with zero labels. Note that partitioning of
+// Histograms is expensive and should be used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
@@ -45,146 +55,174 @@ func InstrumentHandlerInFlight(g prometheus.Gauge, next hermes.Handler) hermes.H
 //
 // Note that this method is only guaranteed to never observe negative durations
 // if used with Go1.9+.
-func InstrumentHandlerDuration(obs prometheus.ObserverVec, next hermes.Handler) hermes.Handler {
-	code, method := checkLabels(obs)
-
-	if code {
-		return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
-			now := time.Now()
-			r := next(req, res)
-			obs.With(labels(code, method, string(req.Method()), req.Raw().Response.StatusCode())).Observe(time.Since(now).Seconds())
-			return r
-		})
-	}
+func InstrumentHandlerDuration(obs prometheus.ObserverVec, next hermes.Handler, opts ...InstrumentOpts) hermes.Handler {
+	return wrapHandler(InstrumentMiddlewareDuration(obs, opts...), next)
+}
 
-	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+// InstrumentMiddlewareDuration is the hermes.Middleware version of
+// InstrumentHandlerDuration. Used with `router.Use`, before the routes are
+// added, it instruments every route of the router at once:
+//
+//	router := promhermes.RecordRoutes(hermes.DefaultRouter())
+//	router.Use(promhermes.InstrumentMiddlewareDuration(durationVec))
+//	router.Get("/users/:id", getUser) // reported as route="/users/:id"
+func InstrumentMiddlewareDuration(obs prometheus.ObserverVec, opts ...InstrumentOpts) hermes.Middleware {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
 		now := time.Now()
 		r := next(req, res)
-		obs.With(labels(code, method, string(req.Method()), 0)).Observe(time.Since(now).Seconds())
+		observers.observer(req).Observe(time.Since(now).Seconds())
 		return r
-	})
+	}
 }
 
 // InstrumentHandlerCounter is a middleware that wraps the provided hermes.Handler
-// to observe the request result with the provided CounterVec.  The CounterVec
-// must have zero, one, or two non-const non-curried labels. For those, the only
-// allowed label names are "code" and "method". The function panics
-// otherwise. Partitioning of the CounterVec happens by HTTP status code and/or
-// HTTP method if the respective instance label names are present in the
-// CounterVec. For unpartitioned counting, use a CounterVec with zero labels.
+// to observe the request result with the provided CounterVec. The CounterVec
+// must have zero or more non-const non-curried labels. For those, the only
+// allowed label names are "code", "method", "route" and the ones with an
+// extractor in opts (see InstrumentOpts). The function panics otherwise.
+// Partitioning of the CounterVec happens by HTTP status code, HTTP method,
+// route pattern and/or the extra labels if the respective instance label
+// names are present in the CounterVec. For unpartitioned counting, use a
+// CounterVec with zero labels.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
 // If the wrapped Handler panics, the Counter is not incremented.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerCounter(counter *prometheus.CounterVec, next hermes.Handler) hermes.Handler {
-	code, method := checkLabels(counter)
-
-	if code {
-		return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
-			r := next(req, res)
-			counter.With(labels(code, method, string(req.Method()), req.Raw().Response.StatusCode())).Inc()
-			return r
-		})
-	}
+func InstrumentHandlerCounter(counter *prometheus.CounterVec, next hermes.Handler, opts ...InstrumentOpts) hermes.Handler {
+	return wrapHandler(InstrumentMiddlewareCounter(counter, opts...), next)
+}
 
-	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+// InstrumentMiddlewareCounter is the hermes.Middleware version of
+// InstrumentHandlerCounter, to be used with `router.Use`.
+func InstrumentMiddlewareCounter(counter *prometheus.CounterVec, opts ...InstrumentOpts) hermes.Middleware {
+	counters := newCounterChildren(counter, newLabeler(counter, opts))
+
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
 		r := next(req, res)
-		counter.With(labels(code, method, string(req.Method()), 0)).Inc()
+		counters.counter(req).Inc()
 		return r
-	})
+	}
 }
 
 // InstrumentHandlerTimeToWriteHeader is a middleware that wraps the provided
 // hermes.Handler to observe with the provided ObserverVec the request duration
-// until the response headers are written. The ObserverVec must have zero, one,
-// or two non-const non-curried labels. For those, the only allowed label names
-// are "code" and "method". The function panics otherwise. The Observe method of
-// the Observer in the ObserverVec is called with the request duration in
-// seconds. Partitioning happens by HTTP status code and/or HTTP method if the
-// respective instance label names are present in the ObserverVec. For
-// unpartitioned observations, use an ObserverVec with zero labels. Note that
-// partitioning of Histograms is expensive and should be used judiciously.
+// until the response starts being written, that is the time to the first
+// byte. The ObserverVec must have zero or more non-const non-curried labels.
+// For those, the only allowed label names are "code", "method", "route" and
+// the ones with an extractor in opts (see InstrumentOpts). The function panics
+// otherwise. The Observe method of the Observer in the ObserverVec is called
+// with the request duration in seconds. Partitioning happens by HTTP status
+// code, HTTP method, route pattern and/or the extra labels if the respective
+// instance label names are present in the ObserverVec. For unpartitioned
+// observations, use an ObserverVec with zero labels. Note that partitioning of
+// Histograms is expensive and should be used judiciously.
 //
-// If the wrapped Handler panics before calling WriteHeader, no value is
-// reported.
+// The response is written once the wrapped Handler returns, so the time to
+// the first byte is usually the duration of the Handler. But if the body is
+// streamed, the Handler returns before the body is produced. If the stream is
+// set with SetBodyStreamWriter (from this package), the time is observed when
+// the stream is first flushed: it tells the think time of the server apart
+// from the time spent streaming the body to slow clients. Other streams, such
+// as the ones set with `req.Raw().SetBodyStreamWriter`, are observed when the
+// Handler returns.
 //
-// Note that this method is only guaranteed to never observe negative durations
-// if used with Go1.9+.
+// If the wrapped Handler does not set a status code, a status code of 200 is assumed.
+//
+// If the wrapped Handler panics, no value is reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-// TODO: try to implement this one using hermes/fasthttp
-// func InstrumentHandlerTimeToWriteHeader(obs prometheus.ObserverVec, next hermes.Handler) hermes.Handler {
-// 	code, method := checkLabels(obs)
-
-// 	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
-// 		now := time.Now()
-// 		d := newDelegator(w, func(status int) {
-// 			obs.With(labels(code, method, r.Method, status)).Observe(time.Since(now).Seconds())
-// 		})
-// 		next.ServeHTTP(d, r)
-// 	})
-// }
+func InstrumentHandlerTimeToWriteHeader(obs prometheus.ObserverVec, next hermes.Handler, opts ...InstrumentOpts) hermes.Handler {
+	return wrapHandler(InstrumentMiddlewareTimeToWriteHeader(obs, opts...), next)
+}
+
+// InstrumentMiddlewareTimeToWriteHeader is the hermes.Middleware version of
+// InstrumentHandlerTimeToWriteHeader, to be used with `router.Use`.
+func InstrumentMiddlewareTimeToWriteHeader(obs prometheus.ObserverVec, opts ...InstrumentOpts) hermes.Middleware {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
+		now := time.Now()
+		r := next(req, res)
+		ttfb.Observe(req.Raw(), observers.observer(req), now)
+		return r
+	}
+}
 
 // InstrumentHandlerRequestSize is a middleware that wraps the provided
-// hermes.Handler to observe the request size with the provided ObserverVec.  The
-// ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the request size in bytes. Partitioning happens by HTTP status
-// code and/or HTTP method if the respective instance label names are present in
-// the ObserverVec. For unpartitioned observations, use an ObserverVec with zero
-// labels. Note that partitioning of Histograms is expensive and should be used
-// judiciously.
+// hermes.Handler to observe the request size with the provided ObserverVec.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method", "route" and the
+// ones with an extractor in opts (see InstrumentOpts). The function panics
+// otherwise. The Observe method of the Observer in the ObserverVec is called
+// with the request size in bytes. Partitioning happens by HTTP status code,
+// HTTP method, route pattern and/or the extra labels if the respective
+// instance label names are present in the ObserverVec. For unpartitioned
+// observations, use an ObserverVec with zero labels. Note that partitioning of
+// Histograms is expensive and should be used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
 // If the wrapped Handler panics, no values are reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerRequestSize(obs prometheus.ObserverVec, next hermes.Handler) hermes.Handler {
-	code, method := checkLabels(obs)
-
-	if code {
-		return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
-			r := next(req, res)
-			size := computeApproximateRequestSize(req)
-			obs.With(labels(code, method, string(req.Method()), req.Raw().Response.StatusCode())).Observe(float64(size))
-			return r
-		})
-	}
+func InstrumentHandlerRequestSize(obs prometheus.ObserverVec, next hermes.Handler, opts ...InstrumentOpts) hermes.Handler {
+	return wrapHandler(InstrumentMiddlewareRequestSize(obs, opts...), next)
+}
 
-	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+// InstrumentMiddlewareRequestSize is the hermes.Middleware version of
+// InstrumentHandlerRequestSize, to be used with `router.Use`.
+func InstrumentMiddlewareRequestSize(obs prometheus.ObserverVec, opts ...InstrumentOpts) hermes.Middleware {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
 		r := next(req, res)
 		size := computeApproximateRequestSize(req)
-		obs.With(labels(code, method, string(req.Method()), 0)).Observe(float64(size))
+		observers.observer(req).Observe(float64(size))
 		return r
-	})
+	}
 }
 
 // InstrumentHandlerResponseSize is a middleware that wraps the provided
-// hermes.Handler to observe the response size with the provided ObserverVec.  The
-// ObserverVec must have zero, one, or two non-const non-curried labels. For
-// those, the only allowed label names are "code" and "method". The function
-// panics otherwise. The Observe method of the Observer in the ObserverVec is
-// called with the response size in bytes. Partitioning happens by HTTP status
-// code and/or HTTP method if the respective instance label names are present in
-// the ObserverVec. For unpartitioned observations, use an ObserverVec with zero
-// labels. Note that partitioning of Histograms is expensive and should be used
-// judiciously.
+// hermes.Handler to observe the response size with the provided ObserverVec.
+// The ObserverVec must have zero or more non-const non-curried labels. For
+// those, the only allowed label names are "code", "method", "route" and the
+// ones with an extractor in opts (see InstrumentOpts). The function panics
+// otherwise. The Observe method of the Observer in the ObserverVec is called
+// with the response size in bytes. Partitioning happens by HTTP status code,
+// HTTP method, route pattern and/or the extra labels if the respective
+// instance label names are present in the ObserverVec. For unpartitioned
+// observations, use an ObserverVec with zero labels. Note that partitioning of
+// Histograms is expensive and should be used judiciously.
 //
 // If the wrapped Handler does not set a status code, a status code of 200 is assumed.
 //
 // If the wrapped Handler panics, no values are reported.
 //
 // See the example for InstrumentHandlerDuration for example usage.
-func InstrumentHandlerResponseSize(obs prometheus.ObserverVec, next hermes.Handler) hermes.Handler {
-	code, method := checkLabels(obs)
-	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+func InstrumentHandlerResponseSize(obs prometheus.ObserverVec, next hermes.Handler, opts ...InstrumentOpts) hermes.Handler {
+	return wrapHandler(InstrumentMiddlewareResponseSize(obs, opts...), next)
+}
+
+// InstrumentMiddlewareResponseSize is the hermes.Middleware version of
+// InstrumentHandlerResponseSize, to be used with `router.Use`.
+func InstrumentMiddlewareResponseSize(obs prometheus.ObserverVec, opts ...InstrumentOpts) hermes.Middleware {
+	observers := newObserverChildren(obs, newLabeler(obs, opts))
+
+	return func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
 		r := next(req, res)
-		obs.With(labels(code, method, string(req.Method()), req.Raw().Response.StatusCode())).Observe(float64(len(req.Raw().Response.Body())))
+		observers.observer(req).Observe(float64(len(req.Raw().Response.Body())))
 		return r
+	}
+}
+
+// wrapHandler applies the middleware to a single handler.
+func wrapHandler(middleware hermes.Middleware, next hermes.Handler) hermes.Handler {
+	return hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+		return middleware(req, res, next)
 	})
 }
 
@@ -202,7 +240,49 @@ func parseHeaders(req hermes.Request) map[string][]string {
 
 }
 
-func checkLabels(c prometheus.Collector) (code bool, method bool) {
+// labeler computes the labels of the requests, for the instance labels of a
+// metric.
+type labeler struct {
+	code, method, route bool
+	extra               []extraLabel
+	allowed             map[string]map[string]struct{}
+}
+
+type extraLabel struct {
+	name    string
+	extract LabelExtractor
+}
+
+// newLabeler checks the instance labels of `c` against the options and
+// returns the labeler of its metrics. It panics if `c` has a label that is
+// neither "code", "method", "route" or one of the extractors of opts.
+func newLabeler(c prometheus.Collector, opts []InstrumentOpts) *labeler {
+	var (
+		extractors = make(map[string]LabelExtractor)
+		allowed    = make(map[string]map[string]struct{})
+	)
+	for _, o := range opts {
+		for name, extract := range o.Labels {
+			if name == "code" || name == "method" || name == "route" {
+				panic(fmt.Sprintf("label %q cannot have an extractor", name))
+			}
+			extractors[name] = extract
+		}
+		for name, values := range o.AllowedValues {
+			set := make(map[string]struct{}, len(values))
+			for _, value := range values {
+				set[value] = struct{}{}
+			}
+			allowed[name] = set
+		}
+	}
+
+	l := &labeler{allowed: allowed}
+	l.code, l.method, l.route, l.extra = checkLabels(c, extractors)
+	return l
+}
+
+func checkLabels(c prometheus.Collector, extractors map[string]LabelExtractor) (code bool, method bool, route bool, extra []extraLabel) {
 	// TODO(beorn7): Remove this hacky way to check for instance labels
 	// once Descriptors can have their dimensionality queried.
 	var (
@@ -238,7 +318,8 @@ func checkLabels(c prometheus.Collector) (code bool, method bool) {
 	// Write out the metric into a proto message and look at the labels.
 	// If the value is not the magicString, it is a constLabel, which doesn't interest us.
 	// If the label is curried, it doesn't interest us.
-	// In all other cases, only "code" or "method" is allowed.
+	// In all other cases, only "code", "method", "route" or a label with an
+	// extractor is allowed.
 	if err := m.Write(&pm); err != nil {
 		panic("error checking metric for labels")
 	}
@@ -252,8 +333,14 @@ func checkLabels(c prometheus.Collector) (code bool, method bool) {
 			code = true
 		case "method":
 			method = true
+		case "route":
+			route = true
 		default:
-			panic("metric partitioned with non-supported labels")
+			extract, ok := extractors[name]
+			if !ok {
+				panic("metric partitioned with non-supported labels")
+			}
+			extra = append(extra, extraLabel{name: name, extract: extract})
 		}
 	}
 	return
@@ -279,49 +366,90 @@ func isLabelCurried(c prometheus.Collector, label string) bool {
 	return true
 }
 
-// emptyLabels is a one-time allocation for non-partitioned metrics to avoid
-// unnecessary allocations on each request.
-var emptyLabels = prometheus.Labels{}
+// childKey identifies a child of a vec by its "code" and "method" labels,
+// sanitized and folded. It is the zero value for the labels the vec does not
+// have.
+type childKey struct {
+	code, method string
+}
 
-func labels(code, method bool, reqMethod string, status int) prometheus.Labels {
-	if !(code || method) {
-		return emptyLabels
+func (l *labeler) key(req hermes.Request) childKey {
+	var key childKey
+	if l.code {
+		key.code = l.fold("code", sanitizeCode(req.Raw().Response.StatusCode()))
 	}
-	labels := prometheus.Labels{}
+	if l.method {
+		key.method = l.fold("method", l.sanitizeMethod(req.Method()))
+	}
+	return key
+}
 
-	if code {
-		labels["code"] = sanitizeCode(status)
+func (l *labeler) keyLabels(key childKey, route string) prometheus.Labels {
+	labels := make(prometheus.Labels, 3+len(l.extra))
+	if l.code {
+		labels["code"] = key.code
 	}
-	if method {
-		labels["method"] = sanitizeMethod(reqMethod)
+	if l.method {
+		labels["method"] = key.method
 	}
+	if l.route {
+		labels["route"] = route
+	}
+	return labels
+}
 
+func (l *labeler) labels(req hermes.Request) prometheus.Labels {
+	var route string
+	if l.route {
+		route = l.fold("route", RoutePattern(req))
+	}
+	labels := l.keyLabels(l.key(req), route)
+	for _, e := range l.extra {
+		labels[e.name] = l.fold(e.name, e.extract(req))
+	}
 	return labels
 }
 
+// fold replaces the values missing from the allow-list of the label by
+// OtherValue.
+func (l *labeler) fold(name, value string) string {
+	if allowed, ok := l.allowed[name]; ok {
+		if _, ok := allowed[value]; !ok {
+			return OtherValue
+		}
+	}
+	return value
+}
+
+// computeApproximateRequestSize measures the request line, the headers and
+// the body. The headers are measured from their raw bytes, as received by the
+// server, so nothing is allocated.
 func computeApproximateRequestSize(req hermes.Request) int {
 	ctx := req.Raw()
 
-	s := 0
-	if ctx.URI() != nil {
-		s += len(ctx.URI().String())
-	}
+	s := len(ctx.Method()) + len(ctx.RequestURI())
 
-	s += len(ctx.Method())
-	header := parseHeaders(req)
-	for name, values := range header {
-		s += len(name)
-		for _, value := range values {
-			s += len(value)
-		}
+	if raw := ctx.Request.Header.RawHeaders(); len(raw) > 0 {
+		s += len(raw)
+	} else {
+		// The request was not parsed by the server (e.g. it was built by a
+		// test), so there are no raw headers.
+		ctx.Request.Header.VisitAll(func(name, value []byte) {
+			s += len(name) + len(value)
+		})
 	}
 
-	s += int(len(ctx.Request.Body()))
+	s += len(ctx.Request.Body())
 	return s
 }
 
-func sanitizeMethod(m string) string {
-	switch m {
+// sanitizeMethod returns the lower-cased method of the request. The
+// non-standard methods are reported as OtherValue, as the clients can send
+// any, unless they are listed in the allow-list of the "method" label.
+func (l *labeler) sanitizeMethod(m []byte) string {
+	// The conversion of `m` does not allocate, as the compiler only uses it
+	// for the comparisons.
+	switch string(m) {
 	case "GET", "get":
 		return "get"
 	case "PUT", "put":
@@ -338,9 +466,16 @@ func sanitizeMethod(m string) string {
 		return "options"
 	case "NOTIFY", "notify":
 		return "notify"
-	default:
-		return strings.ToLower(m)
+	case "PATCH", "patch":
+		return "patch"
+	case "TRACE", "trace":
+		return "trace"
+	}
+	if _, ok := l.allowed["method"]; ok {
+		// fold reports the methods missing from the allow-list.
+		return strings.ToLower(string(m))
 	}
+	return OtherValue
 }
 
 // If the wrapped hermes.Handler has not set a status code, i.e. the value is
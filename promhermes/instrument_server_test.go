@@ -1,8 +1,14 @@
 package promhermes
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"strings"
+	"testing"
+	"time"
 
 	"github.com/valyala/fasthttp"
 
@@ -10,8 +16,52 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// parseRequestCtx creates a fasthttp.RequestCtx from a raw request, as the
+// server does.
+func parseRequestCtx(raw string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	if err := ctx.Request.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		panic(err)
+	}
+	return ctx
+}
+
+const benchmarkRequest = "GET /users/10?fields=name HTTP/1.1\r\n" +
+	"Host: api.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64) Firefox/68.0\r\n" +
+	"Accept: application/json\r\n" +
+	"\r\n"
+
+func benchmarkHandler(req hermes.Request, res hermes.Response) hermes.Result {
+	return res.Data([]byte("OK"))
+}
+
+// benchmarkRouter creates a router serving `/users/:id`, instrumented by the
+// given middlewares.
+func benchmarkRouter(middlewares ...hermes.Middleware) fasthttp.RequestHandler {
+	router := RecordRoutes(hermes.DefaultRouter())
+	router.Use(middlewares...)
+	router.Get("/users/:id", benchmarkHandler)
+	return router.Handler()
+}
+
+// middlewareAllocs returns the allocations per request added by the
+// middlewares, once the partitions are known. The router allocates on its
+// own.
+func middlewareAllocs(middlewares ...hermes.Middleware) float64 {
+	allocs := func(handler fasthttp.RequestHandler) float64 {
+		ctx := parseRequestCtx(benchmarkRequest)
+		handler(ctx)
+		return testing.AllocsPerRun(100, func() {
+			handler(ctx)
+		})
+	}
+	return allocs(benchmarkRouter(middlewares...)) - allocs(benchmarkRouter())
+}
+
 func createRequestCtx(method, path string) *fasthttp.RequestCtx {
 	ctx := &fasthttp.RequestCtx{}
 	ctx.Request.Header.SetMethod(method)
@@ -25,6 +75,7 @@ var _ = Describe("Instrument Server", func() {
 			varLabels     []string
 			constLabels   []string
 			curriedLabels []string
+			extractors    []string
 			ok            bool
 		}{
 			"empty": {
@@ -51,6 +102,18 @@ var _ = Describe("Instrument Server", func() {
 				curriedLabels: []string{},
 				ok:            true,
 			},
+			"route as single var label": {
+				varLabels:     []string{"route"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				ok:            true,
+			},
+			"code, method and route as var labels": {
+				varLabels:     []string{"route", "method", "code"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				ok:            true,
+			},
 			"valid case with all labels used": {
 				varLabels:     []string{"code", "method"},
 				constLabels:   []string{"foo", "bar"},
@@ -93,6 +156,34 @@ var _ = Describe("Instrument Server", func() {
 				curriedLabels: []string{"method"},
 				ok:            false,
 			},
+			"extra label with an extractor": {
+				varLabels:     []string{"route", "tenant"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant"},
+				ok:            true,
+			},
+			"extractor without label": {
+				varLabels:     []string{"method"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant", "host"},
+				ok:            true,
+			},
+			"extra label without an extractor": {
+				varLabels:     []string{"code", "tenant", "host"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"tenant"},
+				ok:            false,
+			},
+			"extractor overriding route": {
+				varLabels:     []string{"route"},
+				constLabels:   []string{},
+				curriedLabels: []string{},
+				extractors:    []string{"route"},
+				ok:            false,
+			},
 		}
 
 		for name, sc := range scenarios {
@@ -121,6 +212,10 @@ var _ = Describe("Instrument Server", func() {
 					c = c.MustCurryWith(prometheus.Labels{l: "dummy"})
 					o = o.MustCurryWith(prometheus.Labels{l: "dummy"})
 				}
+				opts := InstrumentOpts{Labels: map[string]LabelExtractor{}}
+				for _, l := range sc.extractors {
+					opts.Labels[l] = HeaderLabel(l)
+				}
 
 				func() {
 					defer func() {
@@ -132,7 +227,7 @@ var _ = Describe("Instrument Server", func() {
 							Fail("expected panic")
 						}
 					}()
-					InstrumentHandlerCounter(c, nil)
+					InstrumentHandlerCounter(c, nil, opts)
 				}()
 				func() {
 					defer func() {
@@ -144,26 +239,38 @@ var _ = Describe("Instrument Server", func() {
 							Fail("expected panic")
 						}
 					}()
-					InstrumentHandlerDuration(o, nil)
+					InstrumentHandlerDuration(o, nil, opts)
 				}()
 				if sc.ok {
-					// Test if wantCode and wantMethod were detected correctly.
-					var wantCode, wantMethod bool
+					// Test if wantCode, wantMethod, wantRoute and wantExtra were
+					// detected correctly.
+					var (
+						wantCode, wantMethod, wantRoute bool
+						wantExtra                       []string
+					)
 					for _, l := range sc.varLabels {
-						if l == "code" {
+						switch l {
+						case "code":
 							wantCode = true
-						}
-						if l == "method" {
+						case "method":
 							wantMethod = true
+						case "route":
+							wantRoute = true
+						default:
+							wantExtra = append(wantExtra, l)
 						}
 					}
-					gotCode, gotMethod := checkLabels(c)
+					gotCode, gotMethod, gotRoute, gotExtra := checkLabels(c, opts.Labels)
 					Expect(gotCode).To(Equal(wantCode))
 					Expect(gotMethod).To(Equal(wantMethod))
+					Expect(gotRoute).To(Equal(wantRoute))
+					Expect(extraLabelNames(gotExtra)).To(ConsistOf(wantExtra))
 
-					gotCode, gotMethod = checkLabels(o)
+					gotCode, gotMethod, gotRoute, gotExtra = checkLabels(o, opts.Labels)
 					Expect(gotCode).To(Equal(wantCode))
 					Expect(gotMethod).To(Equal(wantMethod))
+					Expect(gotRoute).To(Equal(wantRoute))
+					Expect(extraLabelNames(gotExtra)).To(ConsistOf(wantExtra))
 				}
 			})
 		}
@@ -223,9 +330,9 @@ var _ = Describe("Instrument Server", func() {
 		chain := InstrumentHandlerInFlight(inFlightGauge,
 			InstrumentHandlerCounter(counter,
 				InstrumentHandlerDuration(histVec,
-					// InstrumentHandlerTimeToWriteHeader(writeHeaderVec,
-					InstrumentHandlerResponseSize(responseSize, handler),
-					// ),
+					InstrumentHandlerTimeToWriteHeader(writeHeaderVec,
+						InstrumentHandlerResponseSize(responseSize, handler),
+					),
 				),
 			),
 		)
@@ -235,9 +342,276 @@ var _ = Describe("Instrument Server", func() {
 
 		ctx := createRequestCtx("GET", "/")
 		router.Handler()(ctx)
+
+		var metric dto.Metric
+		Expect(writeHeaderVec.WithLabelValues().(prometheus.Histogram).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Time to first byte", func() {
+	var (
+		histogram *prometheus.HistogramVec
+		router    hermes.Router
+	)
+
+	BeforeEach(func() {
+		histogram = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "time_to_first_byte_seconds",
+				Help: "A histogram of the time to the first byte.",
+			},
+			[]string{"route"},
+		)
+
+		router = RecordRoutes(hermes.DefaultRouter())
+		router.Use(InstrumentMiddlewareTimeToWriteHeader(histogram))
+		router.Get("/users", func(req hermes.Request, res hermes.Response) hermes.Result {
+			return res.Data([]byte("OK"))
+		})
+		router.Get("/export", func(req hermes.Request, res hermes.Response) hermes.Result {
+			SetBodyStreamWriter(req, func(w *bufio.Writer) {
+				time.Sleep(50 * time.Millisecond)
+				w.WriteString("first")
+				w.Flush()
+				time.Sleep(200 * time.Millisecond)
+				w.WriteString(" second")
+			})
+			return res.End()
+		})
+	})
+
+	observed := func(route string) (uint64, float64) {
+		var metric dto.Metric
+		Expect(histogram.WithLabelValues(route).(prometheus.Histogram).Write(&metric)).To(Succeed())
+		return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+	}
+
+	It("should observe when the handler returns", func() {
+		router.Handler()(createRequestCtx("GET", "/users"))
+
+		count, _ := observed("/users")
+		Expect(count).To(BeEquivalentTo(1))
+	})
+
+	It("should observe when a stream is first flushed", func() {
+		ctx := createRequestCtx("GET", "/export")
+		router.Handler()(ctx)
+
+		count, _ := observed("/export")
+		Expect(count).To(BeZero())
+
+		// Write the response as the server does, once the handler has
+		// returned.
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		Expect(ctx.Response.Write(w)).To(Succeed())
+		Expect(w.Flush()).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("first"))
+		Expect(buf.String()).To(ContainSubstring(" second"))
+
+		count, sum := observed("/export")
+		Expect(count).To(BeEquivalentTo(1))
+		Expect(sum).To(BeNumerically(">=", 0.05))
+		Expect(sum).To(BeNumerically("<", 0.25))
 	})
 })
 
+var _ = Describe("Route label", func() {
+	var (
+		counter *prometheus.CounterVec
+		router  hermes.Router
+	)
+
+	BeforeEach(func() {
+		counter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "api_requests_total",
+				Help: "A counter for requests to the router.",
+			},
+			[]string{"code", "method", "route"},
+		)
+		handler := hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+			if req.Param("id") == "missing" {
+				return res.Status(404).Data("missing")
+			}
+			return res.Data([]byte("OK"))
+		})
+
+		router = RecordRoutes(hermes.DefaultRouter())
+		router.Use(InstrumentMiddlewareCounter(counter))
+		router.Get("/users", handler)
+		router.Get("/users/:id", handler)
+		router.Get("/users/:id/roles/:role", handler)
+		router.Post("/users", handler)
+	})
+
+	count := func(code, method, route string) float64 {
+		var metric dto.Metric
+		Expect(counter.WithLabelValues(code, method, route).Write(&metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	It("should report the route pattern", func() {
+		router.Handler()(createRequestCtx("GET", "/users"))
+		router.Handler()(createRequestCtx("GET", "/users/10"))
+		router.Handler()(createRequestCtx("GET", "/users/20"))
+		router.Handler()(createRequestCtx("GET", "/users/users"))
+		router.Handler()(createRequestCtx("GET", "/users/10/roles/admin"))
+		router.Handler()(createRequestCtx("GET", "/users/20/"))
+		router.Handler()(createRequestCtx("GET", "/users/missing"))
+
+		Expect(count("200", "get", "/users")).To(BeEquivalentTo(1))
+		Expect(count("200", "get", "/users/:id")).To(BeEquivalentTo(4))
+		Expect(count("200", "get", "/users/:id/roles/:role")).To(BeEquivalentTo(1))
+		Expect(count("404", "get", "/users/:id")).To(BeEquivalentTo(1))
+	})
+
+	It("should report the pattern of the handler, not the path", func() {
+		// hermes serves `/users/1` with the handler of `/users`.
+		router.Handler()(createRequestCtx("GET", "/users/1"))
+
+		Expect(count("200", "get", "/users")).To(BeEquivalentTo(1))
+	})
+
+	It("should join the prefixes of the routes", func() {
+		router.Prefix("/api").Group(func(api hermes.Routable) {
+			api.With().Get("/roles/:role", func(req hermes.Request, res hermes.Response) hermes.Result {
+				return res.Data([]byte("OK"))
+			})
+		})
+		router.Handler()(createRequestCtx("GET", "/api/roles/admin"))
+
+		Expect(count("200", "get", "/api/roles/:role")).To(BeEquivalentTo(1))
+	})
+
+	It("should report the routes without a pattern as other", func() {
+		router := hermes.DefaultRouter()
+		router.Use(InstrumentMiddlewareCounter(counter))
+		router.Get("/users/:id", func(req hermes.Request, res hermes.Response) hermes.Result {
+			return res.Data([]byte("OK"))
+		})
+		router.Handler()(createRequestCtx("GET", "/users/10"))
+
+		Expect(count("200", "get", OtherRoute)).To(BeEquivalentTo(1))
+	})
+
+	It("should report unmatched requests", func() {
+		router.Handler()(createRequestCtx("GET", "/roles/1"))
+		router.Handler()(createRequestCtx("DELETE", "/users"))
+		router.Handler()(createRequestCtx("OPTIONS", "/users/10"))
+
+		Expect(count("404", "get", UnmatchedRoute)).To(BeEquivalentTo(1))
+		Expect(count("405", "delete", UnmatchedRoute)).To(BeEquivalentTo(1))
+		Expect(count("200", "options", UnmatchedRoute)).To(BeEquivalentTo(1))
+	})
+
+	It("should fold the routes missing from the allow-list", func() {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"route"})
+		handler := benchmarkRouter(InstrumentMiddlewareCounter(counter, InstrumentOpts{
+			AllowedValues: map[string][]string{"route": {"/users"}},
+		}))
+		handler(createRequestCtx("GET", "/users/10"))
+
+		var metric dto.Metric
+		Expect(counter.WithLabelValues(OtherValue).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Extra labels", func() {
+	var (
+		counter *prometheus.CounterVec
+		router  hermes.Router
+	)
+
+	BeforeEach(func() {
+		counter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "api_requests_total",
+				Help: "A counter for requests to the router.",
+			},
+			[]string{"route", "host", "tenant"},
+		)
+
+		router = RecordRoutes(hermes.DefaultRouter())
+		router.Use(InstrumentMiddlewareCounter(counter, InstrumentOpts{
+			Labels: map[string]LabelExtractor{
+				"host":   HostLabel,
+				"tenant": HeaderLabel("X-Tenant"),
+			},
+			AllowedValues: map[string][]string{
+				"host":   {"api.example.com"},
+				"tenant": {"acme", "globex"},
+			},
+		}))
+		router.Get("/users/:id", func(req hermes.Request, res hermes.Response) hermes.Result {
+			return res.Data([]byte("OK"))
+		})
+	})
+
+	request := func(host, tenant string) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/users/10")
+		ctx.Request.Header.SetHost(host)
+		ctx.Request.Header.Set("X-Tenant", tenant)
+		router.Handler()(ctx)
+	}
+
+	count := func(route, host, tenant string) float64 {
+		var metric dto.Metric
+		Expect(counter.WithLabelValues(route, host, tenant).Write(&metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	It("should partition by the extracted values", func() {
+		request("API.example.com", "acme")
+		request("api.example.com", "acme")
+		request("api.example.com", "globex")
+
+		Expect(count("/users/:id", "api.example.com", "acme")).To(BeEquivalentTo(2))
+		Expect(count("/users/:id", "api.example.com", "globex")).To(BeEquivalentTo(1))
+	})
+
+	It("should fold the values missing from the allow-list", func() {
+		request("10.0.0.1", "initech")
+		request("api.example.com", "umbrella")
+
+		Expect(count("/users/:id", OtherValue, OtherValue)).To(BeEquivalentTo(1))
+		Expect(count("/users/:id", "api.example.com", OtherValue)).To(BeEquivalentTo(1))
+	})
+
+	It("should report the non-standard methods as other, unless allowed", func() {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"method"})
+
+		l := newLabeler(counter, nil)
+		Expect(l.sanitizeMethod([]byte("PATCH"))).To(Equal("patch"))
+		Expect(l.sanitizeMethod([]byte("PROPFIND"))).To(Equal(OtherValue))
+
+		l = newLabeler(counter, []InstrumentOpts{{
+			AllowedValues: map[string][]string{"method": {"get", "propfind"}},
+		}})
+		Expect(l.fold("method", l.sanitizeMethod([]byte("PROPFIND")))).To(Equal("propfind"))
+		Expect(l.fold("method", l.sanitizeMethod([]byte("MKCOL")))).To(Equal(OtherValue))
+	})
+
+	It("should classify user agents", func() {
+		Expect(userAgentClass([]byte("Mozilla/5.0 (compatible; bingbot/2.0)"))).To(Equal(UserAgentBot))
+		Expect(userAgentClass([]byte("Mozilla/5.0 (Linux; Android 9; SM-G960F) Mobile Safari/537.36"))).To(Equal(UserAgentMobile))
+		Expect(userAgentClass([]byte("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_5) Safari/605.1.15"))).To(Equal(UserAgentBrowser))
+		Expect(userAgentClass([]byte("curl/7.64.1"))).To(Equal(UserAgentTool))
+		Expect(userAgentClass(nil)).To(Equal(UserAgentUnknown))
+	})
+})
+
+func extraLabelNames(extra []extraLabel) []string {
+	names := make([]string, 0, len(extra))
+	for _, e := range extra {
+		names = append(names, e.name)
+	}
+	return names
+}
+
 func ExampleInstrumentHandlerDuration() {
 	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "in_flight_requests",
@@ -317,3 +691,72 @@ func ExampleInstrumentHandlerDuration() {
 		log.Fatal(err)
 	}
 }
+
+var _ = Describe("Instrument Server allocations", func() {
+	It("should measure the request size from the raw headers", func() {
+		ctx := parseRequestCtx(benchmarkRequest)
+		// The method, the request URI and the raw headers, up to the blank
+		// line.
+		requestLine := len("GET") + len("/users/10?fields=name")
+		headers := len(benchmarkRequest) - strings.Index(benchmarkRequest, "Host:")
+		req := hermes.AcquireRequest(context.Background(), ctx)
+		defer hermes.ReleaseRequest(req)
+		Expect(computeApproximateRequestSize(req)).To(Equal(requestLine + headers))
+	})
+
+	It("should not allocate once the partitions are known", func() {
+		if raceEnabled {
+			Skip("the allocations are not consistent with the race detector")
+		}
+		labels := []string{"code", "method", "route"}
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, labels)
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, labels)
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "g", Help: "g help"})
+
+		Expect(middlewareAllocs(
+			InstrumentMiddlewareInFlight(gauge),
+			InstrumentMiddlewareCounter(counter),
+			InstrumentMiddlewareDuration(histogram),
+			InstrumentMiddlewareRequestSize(histogram),
+			InstrumentMiddlewareResponseSize(histogram),
+		)).To(BeZero())
+	})
+})
+
+func benchmarkInstrumentMiddleware(b *testing.B, middleware hermes.Middleware) {
+	handler := benchmarkRouter(middleware)
+	ctx := parseRequestCtx(benchmarkRequest)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler(ctx)
+	}
+}
+
+// BenchmarkRouter is the baseline of the other benchmarks: the allocations
+// of the router itself.
+func BenchmarkRouter(b *testing.B) {
+	benchmarkInstrumentMiddleware(b, func(req hermes.Request, res hermes.Response, next hermes.Handler) hermes.Result {
+		return next(req, res)
+	})
+}
+
+func BenchmarkInstrumentMiddlewareCounter(b *testing.B) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c", Help: "c help"}, []string{"code", "method", "route"})
+	benchmarkInstrumentMiddleware(b, InstrumentMiddlewareCounter(counter))
+}
+
+func BenchmarkInstrumentMiddlewareDuration(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method", "route"})
+	benchmarkInstrumentMiddleware(b, InstrumentMiddlewareDuration(histogram))
+}
+
+func BenchmarkInstrumentMiddlewareRequestSize(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method", "route"})
+	benchmarkInstrumentMiddleware(b, InstrumentMiddlewareRequestSize(histogram))
+}
+
+func BenchmarkInstrumentMiddlewareResponseSize(b *testing.B) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "h", Help: "h help"}, []string{"code", "method", "route"})
+	benchmarkInstrumentMiddleware(b, InstrumentMiddlewareResponseSize(histogram))
+}
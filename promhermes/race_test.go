@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package promhermes
+
+// raceEnabled skips the allocation specs: with the race detector, sync.Pool
+// drops items randomly, so the router does not allocate consistently.
+const raceEnabled = true
@@ -0,0 +1,162 @@
+package promhermes
+
+import (
+	"strings"
+
+	"github.com/lab259/hermes"
+	"github.com/valyala/fasthttp"
+)
+
+// UnmatchedRoute is the `route` label of the requests that did not match
+// any route of the router (404 and 405 responses).
+const UnmatchedRoute = "unmatched"
+
+// OtherRoute is the `route` label of the requests whose route pattern is not
+// known, as their handler was not registered through Route or RecordRoutes.
+const OtherRoute = "other"
+
+// routeUserValue is the key of the fasthttp.RequestCtx user value holding
+// the pattern recorded by Route.
+const routeUserValue = "promhermes.route"
+
+// RoutePattern returns the pattern of the route that served the request,
+// such as `/users/:id`, as long as it is called after the request was routed
+// (e.g. by a middleware, once `next` returns).
+//
+// hermes does not expose the pattern, so it must be recorded when the route
+// is added, with Route or RecordRoutes. Requests that did not match any
+// route are reported as UnmatchedRoute, and the ones served by a handler
+// without a recorded pattern as OtherRoute, so the raw path never becomes a
+// label.
+func RoutePattern(req hermes.Request) string {
+	ctx := req.Raw()
+	if pattern, ok := ctx.UserValue(routeUserValue).(string); ok {
+		return pattern
+	}
+	if isUnmatched(ctx) {
+		return UnmatchedRoute
+	}
+	return OtherRoute
+}
+
+// Route wraps `handler` so the requests it serves report `pattern` as their
+// route (see RoutePattern). The trailing slash of the pattern is dropped, so
+// `/users/:id/` is reported as `/users/:id`.
+//
+//	router.Get("/users/:id", promhermes.Route("/users/:id", getUser))
+//
+// The pattern must include the prefix of the route, if any. RecordRoutes
+// does that for every route of a router.
+func Route(pattern string, handler hermes.Handler) hermes.Handler {
+	// The pattern is converted to an interface{} once, so setting it as a
+	// user value does not allocate.
+	var value interface{} = normalizeRoute(pattern)
+	return func(req hermes.Request, res hermes.Response) hermes.Result {
+		req.Raw().SetUserValue(routeUserValue, value)
+		return handler(req, res)
+	}
+}
+
+// RecordRoutes wraps `router` so that the routes added to it, including the
+// ones of its prefixes and groups, record their pattern (see Route):
+//
+//	router := promhermes.RecordRoutes(hermes.DefaultRouter())
+//	router.Use(promhermes.InstrumentMiddlewareCounter(requests))
+//	router.Get("/users/:id", getUser) // reported as route="/users/:id"
+func RecordRoutes(router hermes.Router) hermes.Router {
+	return &routeRecorderRouter{
+		routeRecorder: &routeRecorder{Routable: router},
+		router:        router,
+	}
+}
+
+// routeRecorder is a hermes.Routable wrapping the handlers added to it with
+// Route. `prefix` is the pattern of the Routable, joined to the ones of its
+// routes.
+type routeRecorder struct {
+	hermes.Routable
+	prefix string
+}
+
+func (r *routeRecorder) route(path string, handler hermes.Handler) hermes.Handler {
+	return Route(joinRoute(r.prefix, path), handler)
+}
+
+func (r *routeRecorder) Delete(path string, handler hermes.Handler) {
+	r.Routable.Delete(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Get(path string, handler hermes.Handler) {
+	r.Routable.Get(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Head(path string, handler hermes.Handler) {
+	r.Routable.Head(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Options(path string, handler hermes.Handler) {
+	r.Routable.Options(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Patch(path string, handler hermes.Handler) {
+	r.Routable.Patch(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Post(path string, handler hermes.Handler) {
+	r.Routable.Post(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Put(path string, handler hermes.Handler) {
+	r.Routable.Put(path, r.route(path, handler))
+}
+
+func (r *routeRecorder) Prefix(path string) hermes.Routable {
+	return &routeRecorder{
+		Routable: r.Routable.Prefix(path),
+		prefix:   joinRoute(r.prefix, path),
+	}
+}
+
+func (r *routeRecorder) Group(fn func(hermes.Routable)) {
+	r.Routable.Group(func(routable hermes.Routable) {
+		fn(&routeRecorder{Routable: routable, prefix: r.prefix})
+	})
+}
+
+func (r *routeRecorder) With(middlewares ...hermes.Middleware) hermes.Routable {
+	return &routeRecorder{
+		Routable: r.Routable.With(middlewares...),
+		prefix:   r.prefix,
+	}
+}
+
+type routeRecorderRouter struct {
+	*routeRecorder
+	router hermes.Router
+}
+
+func (r *routeRecorderRouter) Handler() fasthttp.RequestHandler {
+	return r.router.Handler()
+}
+
+// joinRoute joins a prefix and a path as hermes does.
+func joinRoute(prefix, path string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// normalizeRoute makes sure the pattern starts with a slash and drops its
+// trailing one, unless it is the root.
+func normalizeRoute(pattern string) string {
+	return "/" + strings.Trim(pattern, "/")
+}
+
+// isUnmatched checks if the response was generated by the router itself,
+// because no route matched the request.
+func isUnmatched(ctx *fasthttp.RequestCtx) bool {
+	switch ctx.Response.StatusCode() {
+	case fasthttp.StatusNotFound, fasthttp.StatusMethodNotAllowed:
+		return true
+	}
+	// The router sets the `Allow` header for the default OPTIONS response.
+	return ctx.IsOptions() && len(ctx.Response.Header.Peek("Allow")) > 0
+}
@@ -0,0 +1,118 @@
+package promhermes
+
+import (
+	"testing"
+
+	"github.com/lab259/hermes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+
+	promsrv "github.com/lab259/go-rscsrv-prometheus"
+)
+
+var _ = Describe("Server Metrics", func() {
+	var (
+		service *promsrv.Service
+		metrics *ServerMetrics
+		router  hermes.Router
+	)
+
+	BeforeEach(func() {
+		service = &promsrv.Service{}
+		metrics = NewServerMetrics(ServerMetricsOpts{
+			Namespace:     "myapp",
+			Registerer:    service,
+			ExcludedPaths: []string{"/metrics"},
+		})
+
+		handler := hermes.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+			return res.Data([]byte("OK"))
+		})
+		router = RecordRoutes(hermes.DefaultRouter())
+		router.Use(metrics.Middleware)
+		router.Get("/metrics", handler)
+		router.Get("/users/:id", handler)
+	})
+
+	families := func() map[string]*dto.MetricFamily {
+		mfs, err := service.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		byName := make(map[string]*dto.MetricFamily, len(mfs))
+		for _, mf := range mfs {
+			byName[mf.GetName()] = mf
+		}
+		return byName
+	}
+
+	It("should register the metrics", func() {
+		router.Handler()(createRequestCtx("GET", "/users/10"))
+
+		Expect(families()).To(HaveLen(5))
+		Expect(families()).To(HaveKey("myapp_http_requests_in_flight"))
+		Expect(families()).To(HaveKey("myapp_http_requests_total"))
+		Expect(families()).To(HaveKey("myapp_http_request_duration_seconds"))
+		Expect(families()).To(HaveKey("myapp_http_request_size_bytes"))
+		Expect(families()).To(HaveKey("myapp_http_response_size_bytes"))
+	})
+
+	It("should reuse the metrics already registered", func() {
+		again := NewServerMetrics(ServerMetricsOpts{Namespace: "myapp", Registerer: service})
+		Expect(again.Requests).To(BeIdenticalTo(metrics.Requests))
+		Expect(again.ResponseSize).To(BeIdenticalTo(metrics.ResponseSize))
+	})
+
+	It("should record the requests by route", func() {
+		router.Handler()(createRequestCtx("GET", "/users/10"))
+		router.Handler()(createRequestCtx("GET", "/users/20"))
+		router.Handler()(createRequestCtx("GET", "/roles"))
+
+		mfs := families()
+		requests := mfs["myapp_http_requests_total"].GetMetric()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].GetLabel()[0].GetValue()).To(Equal("200"))
+		Expect(requests[0].GetLabel()[2].GetValue()).To(Equal("/users/:id"))
+		Expect(requests[0].GetCounter().GetValue()).To(BeEquivalentTo(2))
+		Expect(requests[1].GetLabel()[0].GetValue()).To(Equal("404"))
+		Expect(requests[1].GetLabel()[2].GetValue()).To(Equal(UnmatchedRoute))
+
+		duration := mfs["myapp_http_request_duration_seconds"].GetMetric()
+		Expect(duration[0].GetHistogram().GetSampleCount()).To(BeEquivalentTo(2))
+
+		Expect(mfs["myapp_http_requests_in_flight"].GetMetric()[0].GetGauge().GetValue()).To(BeZero())
+	})
+
+	It("should not allocate once the partitions are known", func() {
+		if raceEnabled {
+			Skip("the allocations are not consistent with the race detector")
+		}
+		metrics := NewServerMetrics(ServerMetricsOpts{Registerer: &promsrv.Service{}})
+		Expect(middlewareAllocs(metrics.Middleware)).To(BeZero())
+	})
+
+	It("should not record the excluded paths", func() {
+		ctx := createRequestCtx("GET", "/metrics")
+		router.Handler()(ctx)
+
+		Expect(string(ctx.Response.Body())).To(Equal("OK"))
+		Expect(families()["myapp_http_requests_total"].GetMetric()).To(BeEmpty())
+	})
+
+	It("should wrap a single handler", func() {
+		handler := metrics.Handler(func(req hermes.Request, res hermes.Response) hermes.Result {
+			return res.Data([]byte("OK"))
+		})
+		router := hermes.DefaultRouter()
+		router.Get("/health", Route("/health", handler))
+		router.Handler()(createRequestCtx("GET", "/health"))
+
+		requests := families()["myapp_http_requests_total"].GetMetric()
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].GetLabel()[2].GetValue()).To(Equal("/health"))
+	})
+})
+
+func BenchmarkServerMetrics(b *testing.B) {
+	metrics := NewServerMetrics(ServerMetricsOpts{Registerer: &promsrv.Service{}})
+	benchmarkInstrumentMiddleware(b, metrics.Middleware)
+}
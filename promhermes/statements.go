@@ -0,0 +1,38 @@
+package promhermes
+
+import (
+	"strconv"
+
+	"github.com/lab259/errors/v2"
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+	"github.com/lab259/hermes"
+)
+
+// StatementsHandler returns an hermes.Handler that renders, as JSON, the
+// statements tracked by the given promsql.StatementTracker.
+//
+// The `sort` query parameter (`total`, `mean`, `max` or `count`) defines the
+// order of the statements and `limit` how many of them are rendered. A
+// DELETE request resets the tracker.
+func StatementsHandler(tracker *promsql.StatementTracker) hermes.Handler {
+	return func(req hermes.Request, res hermes.Response) hermes.Result {
+		if string(req.Method()) == "DELETE" {
+			tracker.Reset()
+			return res.Data([]promsql.StatementStats{})
+		}
+
+		order, err := promsql.ParseStatementOrder(string(req.Query("sort")))
+		if err != nil {
+			return res.Error(err, err.Error(), hermes.StatusBadRequest, errors.Code("invalid-sort"), errors.Module("promhermes"))
+		}
+
+		limit := 0
+		if s := req.Query("limit"); len(s) > 0 {
+			if limit, err = strconv.Atoi(string(s)); err != nil {
+				return res.Error(err, "Invalid limit.", hermes.StatusBadRequest, errors.Code("invalid-limit"), errors.Module("promhermes"))
+			}
+		}
+
+		return res.Data(tracker.Top(limit, order))
+	}
+}
@@ -0,0 +1,57 @@
+package promhermes
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lab259/hermes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+var _ = Describe("Statements Handler", func() {
+	var (
+		tracker *promsql.StatementTracker
+		router  hermes.Router
+	)
+
+	BeforeEach(func() {
+		tracker = promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT a FROM b", 3*time.Second, nil)
+
+		router = hermes.DefaultRouter()
+		router.Get("/statements", StatementsHandler(tracker))
+		router.Delete("/statements", StatementsHandler(tracker))
+	})
+
+	It("should render the statements as JSON", func() {
+		ctx := createRequestCtx("GET", "/statements")
+		ctx.Request.URI().SetQueryString("sort=count&limit=1")
+		router.Handler()(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(hermes.StatusOK))
+
+		var statements []map[string]interface{}
+		Expect(json.Unmarshal(ctx.Response.Body(), &statements)).To(Succeed())
+		Expect(statements).To(HaveLen(1))
+		Expect(statements[0]).To(HaveKeyWithValue("fingerprint", "select ?"))
+		Expect(statements[0]).To(HaveKeyWithValue("count", BeEquivalentTo(2)))
+	})
+
+	It("should reject invalid orders", func() {
+		ctx := createRequestCtx("GET", "/statements")
+		ctx.Request.URI().SetQueryString("sort=slowest")
+		router.Handler()(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(hermes.StatusBadRequest))
+	})
+
+	It("should reset the tracker", func() {
+		ctx := createRequestCtx("DELETE", "/statements")
+		router.Handler()(ctx)
+		Expect(ctx.Response.StatusCode()).To(Equal(hermes.StatusOK))
+		Expect(tracker.Top(0, promsql.OrderByTotalDuration)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,16 @@
+package promhermes
+
+import (
+	"github.com/lab259/hermes"
+	"github.com/valyala/fasthttp"
+
+	"github.com/lab259/go-rscsrv-prometheus/internal/ttfb"
+)
+
+// SetBodyStreamWriter sets the body stream writer of the response, as
+// `req.Raw().SetBodyStreamWriter` does, so that
+// InstrumentMiddlewareTimeToWriteHeader observes the time to the first flush
+// of the stream, instead of the time the handler returns.
+func SetBodyStreamWriter(req hermes.Request, sw fasthttp.StreamWriter) {
+	ttfb.SetBodyStreamWriter(req.Raw(), sw)
+}
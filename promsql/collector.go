@@ -3,21 +3,37 @@ package promsql
 import (
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type DatabaseCollectorOpts struct {
 	Prefix string
+	// SampleInterval enables the pool sampler of `NewDatabaseCollector`:
+	// between `Start` and `Stop`, the pool stats are read every
+	// `SampleInterval` (e.g. 100ms), feeding histograms of the connections
+	// in use and waited for, and their maximums since the last scrape.
+	SampleInterval time.Duration
+	// InUseBuckets defines the buckets of the sampled connections in use
+	// histogram. If nil, exponential buckets from 1 to 512 are used.
+	InUseBuckets []float64
+	// WaitCountBuckets defines the buckets of the connections waited for
+	// between samples histogram. If nil, exponential buckets from 1 to 512
+	// are used.
+	WaitCountBuckets []float64
 }
 
 type dbStats interface {
 	Stats() sql.DBStats
 }
 
-type databaseCollector struct {
-	db                      dbStats
+// databaseDescs describes the metrics read from `sql.DBStats`, shared by the
+// single and the multi database collectors.
+type databaseDescs struct {
 	descMaxOpenConnections  *prometheus.Desc
 	descPoolOpenConnections *prometheus.Desc
 	descPoolInUse           *prometheus.Desc
@@ -26,47 +42,207 @@ type databaseCollector struct {
 	descWaitDuration        *prometheus.Desc
 	descMaxIdleClosed       *prometheus.Desc
 	descMaxLifetimeClosed   *prometheus.Desc
+	descWaitDurationSeconds *prometheus.Desc
+	descMaxIdleTimeClosed   *prometheus.Desc
 }
 
-func NewDatabaseCollector(db dbStats, opts DatabaseCollectorOpts) *databaseCollector {
+// newDatabaseDescs creates the descriptions of the metrics. The raw
+// `wait_duration`, in nanoseconds, is only kept by the single database
+// collector, for compatibility. `max_idle_time_closed` is only available
+// from Go 1.15 on.
+func newDatabaseDescs(opts DatabaseCollectorOpts, labels []string, rawWaitDuration bool) databaseDescs {
+	prefix := databaseCollectorPrefix(opts)
+	descs := databaseDescs{
+		descMaxOpenConnections:  prometheus.NewDesc(fmt.Sprintf("db_%smax_open_connections", prefix), "Maximum number of open connections to the database.", labels, nil),
+		descPoolOpenConnections: prometheus.NewDesc(fmt.Sprintf("db_%spool_open_connections", prefix), "The number of established connections both in use and idle.", labels, nil),
+		descPoolInUse:           prometheus.NewDesc(fmt.Sprintf("db_%spool_in_use", prefix), "The number of connections currently in use.", labels, nil),
+		descPoolIdle:            prometheus.NewDesc(fmt.Sprintf("db_%spool_idle", prefix), "The number of idle connections.", labels, nil),
+		descWaitCount:           prometheus.NewDesc(fmt.Sprintf("db_%swait_count", prefix), "The total number of connections waited for.", labels, nil),
+		descMaxIdleClosed:       prometheus.NewDesc(fmt.Sprintf("db_%smax_idle_closed", prefix), "The total number of connections closed due to SetMaxIdleConns.", labels, nil),
+		descMaxLifetimeClosed:   prometheus.NewDesc(fmt.Sprintf("db_%smax_lifetime_closed", prefix), "The total number of connections closed due to SetConnMaxLifetime.", labels, nil),
+		descWaitDurationSeconds: prometheus.NewDesc(fmt.Sprintf("db_%swait_duration_seconds", prefix), "The total time (in seconds) blocked waiting for a new connection.", labels, nil),
+	}
+	if rawWaitDuration {
+		descs.descWaitDuration = prometheus.NewDesc(fmt.Sprintf("db_%swait_duration", prefix), "The total time blocked waiting for a new connection.", labels, nil)
+	}
+	if _, ok := maxIdleTimeClosed(sql.DBStats{}); ok {
+		descs.descMaxIdleTimeClosed = prometheus.NewDesc(fmt.Sprintf("db_%smax_idle_time_closed", prefix), "The total number of connections closed due to SetConnMaxIdleTime.", labels, nil)
+	}
+	return descs
+}
+
+func databaseCollectorPrefix(opts DatabaseCollectorOpts) string {
 	prefix := opts.Prefix
 	if prefix != "" && !strings.HasSuffix(opts.Prefix, "_") {
 		prefix += "_"
 	}
-	return &databaseCollector{
-		db:                      db,
-		descMaxOpenConnections:  prometheus.NewDesc(fmt.Sprintf("db_%smax_open_connections", prefix), "Maximum number of open connections to the database.", nil, nil),
-		descPoolOpenConnections: prometheus.NewDesc(fmt.Sprintf("db_%spool_open_connections", prefix), "The number of established connections both in use and idle.", nil, nil),
-		descPoolInUse:           prometheus.NewDesc(fmt.Sprintf("db_%spool_in_use", prefix), "The number of connections currently in use.", nil, nil),
-		descPoolIdle:            prometheus.NewDesc(fmt.Sprintf("db_%spool_idle", prefix), "The number of idle connections.", nil, nil),
-		descWaitCount:           prometheus.NewDesc(fmt.Sprintf("db_%swait_count", prefix), "The total number of connections waited for.", nil, nil),
-		descWaitDuration:        prometheus.NewDesc(fmt.Sprintf("db_%swait_duration", prefix), "The total time blocked waiting for a new connection.", nil, nil),
-		descMaxIdleClosed:       prometheus.NewDesc(fmt.Sprintf("db_%smax_idle_closed", prefix), "The total number of connections closed due to SetMaxIdleConns.", nil, nil),
-		descMaxLifetimeClosed:   prometheus.NewDesc(fmt.Sprintf("db_%smax_lifetime_closed", prefix), "The total number of connections closed due to SetConnMaxLifetime.", nil, nil),
+	return prefix
+}
+
+func (descs *databaseDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- descs.descMaxOpenConnections
+	ch <- descs.descPoolOpenConnections
+	ch <- descs.descPoolInUse
+	ch <- descs.descPoolIdle
+	ch <- descs.descWaitCount
+	if descs.descWaitDuration != nil {
+		ch <- descs.descWaitDuration
+	}
+	ch <- descs.descMaxIdleClosed
+	ch <- descs.descMaxLifetimeClosed
+	ch <- descs.descWaitDurationSeconds
+	if descs.descMaxIdleTimeClosed != nil {
+		ch <- descs.descMaxIdleTimeClosed
+	}
+}
+
+func (descs *databaseDescs) collect(ch chan<- prometheus.Metric, stats sql.DBStats, labelValues ...string) {
+	ch <- prometheus.MustNewConstMetric(descs.descMaxOpenConnections, prometheus.GaugeValue, float64(stats.MaxOpenConnections), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descPoolOpenConnections, prometheus.GaugeValue, float64(stats.OpenConnections), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descPoolInUse, prometheus.GaugeValue, float64(stats.InUse), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descPoolIdle, prometheus.GaugeValue, float64(stats.Idle), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descWaitCount, prometheus.CounterValue, float64(stats.WaitCount), labelValues...)
+	if descs.descWaitDuration != nil {
+		ch <- prometheus.MustNewConstMetric(descs.descWaitDuration, prometheus.CounterValue, float64(stats.WaitDuration), labelValues...)
+	}
+	ch <- prometheus.MustNewConstMetric(descs.descMaxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descMaxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), labelValues...)
+	ch <- prometheus.MustNewConstMetric(descs.descWaitDurationSeconds, prometheus.CounterValue, stats.WaitDuration.Seconds(), labelValues...)
+	if descs.descMaxIdleTimeClosed != nil {
+		closed, _ := maxIdleTimeClosed(stats)
+		ch <- prometheus.MustNewConstMetric(descs.descMaxIdleTimeClosed, prometheus.CounterValue, float64(closed), labelValues...)
 	}
 }
 
+type databaseCollector struct {
+	databaseDescs
+	db      dbStats
+	sampler *poolSampler
+}
+
+func NewDatabaseCollector(db dbStats, opts DatabaseCollectorOpts) *databaseCollector {
+	collector := &databaseCollector{
+		databaseDescs: newDatabaseDescs(opts, nil, true),
+		db:            db,
+	}
+	if opts.SampleInterval > 0 {
+		collector.sampler = newPoolSampler(db, databaseCollectorPrefix(opts), opts)
+	}
+	return collector
+}
+
 // Describe returns the description of metrics colllected by this collector.
 func (collector *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- collector.descMaxOpenConnections
-	ch <- collector.descPoolOpenConnections
-	ch <- collector.descPoolInUse
-	ch <- collector.descPoolIdle
-	ch <- collector.descWaitCount
-	ch <- collector.descWaitDuration
-	ch <- collector.descMaxIdleClosed
-	ch <- collector.descMaxLifetimeClosed
+	collector.describe(ch)
+	if collector.sampler != nil {
+		collector.sampler.describe(ch)
+	}
 }
 
 // Collect gets the database stats information and provides it to the prometheus.
 func (collector *databaseCollector) Collect(ch chan<- prometheus.Metric) {
 	stats := collector.db.Stats()
-	ch <- prometheus.MustNewConstMetric(collector.descMaxOpenConnections, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
-	ch <- prometheus.MustNewConstMetric(collector.descPoolOpenConnections, prometheus.GaugeValue, float64(stats.OpenConnections))
-	ch <- prometheus.MustNewConstMetric(collector.descPoolInUse, prometheus.GaugeValue, float64(stats.InUse))
-	ch <- prometheus.MustNewConstMetric(collector.descPoolIdle, prometheus.GaugeValue, float64(stats.Idle))
-	ch <- prometheus.MustNewConstMetric(collector.descWaitCount, prometheus.CounterValue, float64(stats.WaitCount))
-	ch <- prometheus.MustNewConstMetric(collector.descWaitDuration, prometheus.CounterValue, float64(stats.WaitDuration))
-	ch <- prometheus.MustNewConstMetric(collector.descMaxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
-	ch <- prometheus.MustNewConstMetric(collector.descMaxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+	collector.collect(ch, stats)
+	if collector.sampler != nil {
+		collector.sampler.collect(ch, stats)
+	}
+}
+
+// Start implements the rscsrv.Startable interface, starting the pool sampler
+// when DatabaseCollectorOpts.SampleInterval is set. Otherwise, it is a
+// no-op.
+func (collector *databaseCollector) Start() error {
+	if collector.sampler != nil {
+		collector.sampler.start()
+	}
+	return nil
+}
+
+// Stop implements the rscsrv.Startable interface, stopping the pool sampler.
+func (collector *databaseCollector) Stop() error {
+	if collector.sampler != nil {
+		collector.sampler.stop()
+	}
+	return nil
+}
+
+// Restart implements the rscsrv.Startable interface.
+func (collector *databaseCollector) Restart() error {
+	if err := collector.Stop(); err != nil {
+		return err
+	}
+	return collector.Start()
+}
+
+var databasesCollectorLabels = []string{"db"}
+
+// DatabasesCollector collects the stats of several named connection pools
+// (e.g. a primary and its replicas) under a single set of metrics,
+// partitioned by the `db` label.
+type DatabasesCollector struct {
+	databaseDescs
+
+	mu  sync.RWMutex
+	dbs map[string]dbStats
+}
+
+// NewDatabasesCollector returns a new instance of *DatabasesCollector without
+// any pool. Use `Add` to add them.
+func NewDatabasesCollector(opts DatabaseCollectorOpts) *DatabasesCollector {
+	return &DatabasesCollector{
+		databaseDescs: newDatabaseDescs(opts, databasesCollectorLabels, false),
+		dbs:           make(map[string]dbStats),
+	}
+}
+
+// Add starts collecting the stats of `db` under the given name, replacing
+// the pool previously added with the same name, if any. It can be called
+// at any time, even after the collector is registered.
+func (collector *DatabasesCollector) Add(name string, db dbStats) {
+	collector.mu.Lock()
+	collector.dbs[name] = db
+	collector.mu.Unlock()
+}
+
+// Remove stops collecting the stats of the pool added with the given name.
+// It returns false if there is no such pool.
+func (collector *DatabasesCollector) Remove(name string) bool {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if _, ok := collector.dbs[name]; !ok {
+		return false
+	}
+	delete(collector.dbs, name)
+	return true
+}
+
+// Names returns the names of the pools collected, sorted.
+func (collector *DatabasesCollector) Names() []string {
+	collector.mu.RLock()
+	names := make([]string, 0, len(collector.dbs))
+	for name := range collector.dbs {
+		names = append(names, name)
+	}
+	collector.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Describe implements the prometheus.Collector interface.
+func (collector *DatabasesCollector) Describe(ch chan<- *prometheus.Desc) {
+	collector.describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (collector *DatabasesCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.mu.RLock()
+	dbs := make(map[string]dbStats, len(collector.dbs))
+	for name, db := range collector.dbs {
+		dbs[name] = db
+	}
+	collector.mu.RUnlock()
+
+	for name, db := range dbs {
+		collector.collect(ch, db.Stats(), name)
+	}
 }
@@ -2,7 +2,9 @@ package promsql_test
 
 import (
 	"database/sql"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -50,6 +52,10 @@ var _ = Describe("Database Collector", func() {
 		Expect((<-ch).String()).To(ContainSubstring("db_wait_duration"))
 		Expect((<-ch).String()).To(ContainSubstring("db_max_idle_closed"))
 		Expect((<-ch).String()).To(ContainSubstring("db_max_lifetime_closed"))
+		Expect((<-ch).String()).To(ContainSubstring("db_wait_duration_seconds"))
+		for desc := range ch {
+			Expect(desc.String()).To(ContainSubstring("db_max_idle_time_closed"))
+		}
 	})
 
 	It("should generate description names with prefix", func() {
@@ -70,6 +76,10 @@ var _ = Describe("Database Collector", func() {
 		Expect((<-ch).String()).To(ContainSubstring("db_test_wait_duration"))
 		Expect((<-ch).String()).To(ContainSubstring("db_test_max_idle_closed"))
 		Expect((<-ch).String()).To(ContainSubstring("db_test_max_lifetime_closed"))
+		Expect((<-ch).String()).To(ContainSubstring("db_test_wait_duration_seconds"))
+		for desc := range ch {
+			Expect(desc.String()).To(ContainSubstring("db_test_max_idle_time_closed"))
+		}
 	})
 
 	It("should generate default metric values", func() {
@@ -97,5 +107,156 @@ var _ = Describe("Database Collector", func() {
 		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(7.0))
 		Expect((<-ch).Write(&metric)).To(Succeed())
 		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(8))
+		Expect((<-ch).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(6e-9))
+		for m := range ch {
+			Expect(m.Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(0))
+		}
+	})
+})
+
+var _ = Describe("Databases Collector", func() {
+	It("should partition the metrics by db", func() {
+		collector := promsql.NewDatabasesCollector(promsql.DatabaseCollectorOpts{})
+		collector.Add("primary", &fakeDB{})
+		collector.Add("replica", &fakeDB{})
+		Expect(collector.Names()).To(Equal([]string{"primary", "replica"}))
+
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(collector)).To(Succeed())
+		families, err := registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		byName := make(map[string]*dto.MetricFamily, len(families))
+		for _, family := range families {
+			byName[family.GetName()] = family
+		}
+		Expect(byName).ToNot(HaveKey("db_wait_duration"))
+		inUse := byName["db_pool_in_use"].GetMetric()
+		Expect(inUse).To(HaveLen(2))
+		Expect(inUse[0].GetLabel()[0].GetName()).To(Equal("db"))
+		Expect(inUse[0].GetLabel()[0].GetValue()).To(Equal("primary"))
+		Expect(inUse[1].GetLabel()[0].GetValue()).To(Equal("replica"))
+		Expect(inUse[1].GetGauge().GetValue()).To(BeEquivalentTo(3))
+		Expect(byName["db_wait_duration_seconds"].GetMetric()[0].GetCounter().GetValue()).To(BeEquivalentTo(6e-9))
+	})
+
+	It("should add and remove pools at runtime", func() {
+		collector := promsql.NewDatabasesCollector(promsql.DatabaseCollectorOpts{Prefix: "app"})
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(collector)).To(Succeed())
+
+		collector.Add("primary", &fakeDB{})
+		families, err := registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(families).ToNot(BeEmpty())
+		Expect(families[0].GetName()).To(HavePrefix("db_app_"))
+
+		Expect(collector.Remove("primary")).To(BeTrue())
+		Expect(collector.Remove("primary")).To(BeFalse())
+		families, err = registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(families).To(BeEmpty())
+	})
+})
+
+// fakePool has stats that can be changed while sampled.
+type fakePool struct {
+	mu    sync.Mutex
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *fakePool) set(inUse int, waitCount int64) {
+	p.mu.Lock()
+	p.stats.InUse, p.stats.WaitCount = inUse, waitCount
+	p.mu.Unlock()
+}
+
+var _ = Describe("Database Collector sampler", func() {
+	It("should report the saturation between scrapes", func() {
+		pool := &fakePool{}
+		collector := promsql.NewDatabaseCollector(pool, promsql.DatabaseCollectorOpts{
+			SampleInterval: time.Millisecond,
+		})
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(collector)).To(Succeed())
+
+		gather := func() map[string]*dto.MetricFamily {
+			families, err := registry.Gather()
+			Expect(err).ShouldNot(HaveOccurred())
+			byName := make(map[string]*dto.MetricFamily, len(families))
+			for _, family := range families {
+				byName[family.GetName()] = family
+			}
+			return byName
+		}
+
+		Expect(collector.Start()).To(Succeed())
+		pool.set(8, 0)
+		Eventually(func() uint64 {
+			return gather()["db_pool_in_use_sampled"].GetMetric()[0].GetHistogram().GetSampleCount()
+		}).Should(BeNumerically(">", 0))
+		pool.set(8, 5)
+		Eventually(func() float64 {
+			return gather()["db_wait_count_delta"].GetMetric()[0].GetHistogram().GetSampleSum()
+		}).Should(BeEquivalentTo(5))
+		pool.set(1, 5)
+		Expect(collector.Stop()).To(Succeed())
+
+		// The spike was reported by the previous scrapes.
+		families := gather()
+		Expect(families["db_pool_in_use"].GetMetric()[0].GetGauge().GetValue()).To(BeEquivalentTo(1))
+		Expect(families["db_wait_count_delta_max"].GetMetric()[0].GetGauge().GetValue()).To(BeEquivalentTo(0))
+	})
+
+	It("should keep the maximum until the next scrape", func() {
+		pool := &fakePool{}
+		collector := promsql.NewDatabaseCollector(pool, promsql.DatabaseCollectorOpts{
+			SampleInterval: time.Millisecond,
+		})
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(collector)).To(Succeed())
+
+		Expect(collector.Start()).To(Succeed())
+		pool.set(8, 0)
+		time.Sleep(20 * time.Millisecond)
+		pool.set(8, 3)
+		time.Sleep(20 * time.Millisecond)
+		pool.set(1, 3)
+		time.Sleep(20 * time.Millisecond)
+		Expect(collector.Stop()).To(Succeed())
+
+		families, err := registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		values := make(map[string]float64)
+		for _, family := range families {
+			if family.GetType() == dto.MetricType_GAUGE {
+				values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		Expect(values["db_pool_in_use"]).To(BeEquivalentTo(1))
+		Expect(values["db_pool_in_use_max"]).To(BeEquivalentTo(8))
+		Expect(values["db_wait_count_delta_max"]).To(BeEquivalentTo(3))
+	})
+
+	It("should not report the sampler metrics when disabled", func() {
+		collector := promsql.NewDatabaseCollector(&fakeDB{}, promsql.DatabaseCollectorOpts{})
+		Expect(collector.Start()).To(Succeed())
+		Expect(collector.Stop()).To(Succeed())
+
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(collector)).To(Succeed())
+		families, err := registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		for _, family := range families {
+			Expect(family.GetName()).ToNot(ContainSubstring("sampled"))
+		}
 	})
 })
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -22,6 +23,13 @@ type DriverCollector struct {
 	parent     driver.Driver
 	connector  driver.Connector
 
+	classifyStatements bool
+	fingerprints       *fingerprintSet
+	errorClassifier    ErrorClassifier
+	leaks              *leakTracker
+	hooks              DriverHooks
+	slowQueries        *slowQueryLog
+
 	// prometheus counters
 	QueryTotalCounter                    prometheus.Counter
 	QuerySuccessfulCounter               prometheus.Counter
@@ -35,11 +43,120 @@ type DriverCollector struct {
 	ExecutionTotalCounter                prometheus.Counter
 	ExecutionSuccessfulCounter           prometheus.Counter
 	ExecutionFailedCounter               prometheus.Counter
+	FailuresCounter                      *prometheus.CounterVec
+	ConnectionOpenedCounter              prometheus.Counter
+	ConnectionOpenFailedCounter          prometheus.Counter
+	ConnectionClosedCounter              prometheus.Counter
+	PingTotalCounter                     prometheus.Counter
+	PingFailedCounter                    prometheus.Counter
+	ResetSessionTotalCounter             prometheus.Counter
+	ResetSessionFailedCounter            prometheus.Counter
+	TransactionBeginCounter              *prometheus.CounterVec
+	SlowQueriesCounter                   *prometheus.CounterVec
+
+	// prometheus gauges
+	TransactionsInFlightGauge prometheus.Gauge
+	OpenRowsGauge             prometheus.Gauge
+	OpenObjectsGauge          *prometheus.GaugeVec
+	OldestOpenObjectAgeGauge  *prometheus.GaugeVec
+
+	// prometheus histograms
+	DurationHistogram            *prometheus.HistogramVec
+	ConnectionLifetimeHistogram  prometheus.Histogram
+	TransactionDurationHistogram *prometheus.HistogramVec
+	RowsHistogram                *prometheus.HistogramVec
 }
 
 type DriverCollectorOpts struct {
 	DriverName string
 	Prefix     string
+	// Buckets defines the buckets used by the duration histogram. If nil,
+	// prometheus.DefBuckets is used.
+	Buckets []float64
+	// ClassifyStatements adds the `verb` (select, insert, update, delete,
+	// ddl or other) and `table` labels to the duration histogram.
+	ClassifyStatements bool
+	// Fingerprint adds the `fingerprint` label, the statement normalized
+	// with its literals stripped, to the duration histogram.
+	Fingerprint bool
+	// MaxFingerprints limits the number of distinct fingerprints reported.
+	// Statements exceeding it are reported as "other". Defaults to 100.
+	MaxFingerprints int
+	// ErrorClassifier classifies the errors reported by the `error` label of
+	// the failures counter. The DefaultErrorClassifier is used when it is nil
+	// or cannot classify an error.
+	ErrorClassifier ErrorClassifier
+	// ConnectionLifetimeBuckets defines the buckets used by the connection
+	// lifetime histogram. If nil, exponential buckets from 1 second to about
+	// 4.5 hours are used.
+	ConnectionLifetimeBuckets []float64
+	// TransactionBuckets defines the buckets used by the transaction duration
+	// histogram. If nil, exponential buckets from 5 milliseconds to about 5
+	// minutes are used.
+	TransactionBuckets []float64
+	// RowsBuckets defines the buckets used by the rows per query histogram.
+	// If nil, exponential buckets from 1 to 65536 rows are used.
+	RowsBuckets []float64
+	// LeakDebug captures the stack trace of every statement, result set and
+	// transaction created, so the ones left open can be traced back to their
+	// call site. Capturing stack traces is expensive: enable it only while
+	// hunting leaks.
+	LeakDebug bool
+	// LeakThreshold is the age after which an object still open is reported
+	// to OnLeak. Defaults to 1 minute.
+	LeakThreshold time.Duration
+	// OnLeak is called, once per object, with the statements, result sets
+	// and transactions open for longer than LeakThreshold. Objects are
+	// checked whenever the collector is scraped.
+	OnLeak func(OpenObject)
+	// Hooks is called around every operation, on top of the built-in
+	// metrics. Use ChainHooks to combine several of them.
+	Hooks DriverHooks
+	// SlowQuery reports the queries and executions slower than its
+	// threshold. Disabled by default.
+	SlowQuery SlowQueryOpts
+}
+
+// defaultConnectionLifetimeBuckets goes from 1 second to 16384 seconds
+// (about 4.5 hours).
+var defaultConnectionLifetimeBuckets = prometheus.ExponentialBuckets(1, 4, 8)
+
+// defaultTransactionBuckets goes from 5 milliseconds to 327.68 seconds
+// (about 5.5 minutes).
+var defaultTransactionBuckets = prometheus.ExponentialBuckets(0.005, 4, 9)
+
+// defaultRowsBuckets goes from 1 to 65536 rows.
+var defaultRowsBuckets = prometheus.ExponentialBuckets(1, 4, 9)
+
+// Values reported by the `outcome` label of the duration histogram.
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+var driverCollectorDurationLabels = []string{"name", "operation", "outcome"}
+
+var driverCollectorFailuresLabels = []string{"operation", "error"}
+
+var driverCollectorTransactionBeginLabels = []string{"isolation", "read_only", "outcome"}
+
+var driverCollectorTransactionDurationLabels = []string{"operation"}
+
+var driverCollectorRowsLabels = []string{"name"}
+
+var driverCollectorSlowQueriesLabels = []string{"name"}
+
+// durationLabels returns the labels of the duration histogram, depending on
+// the statement classification options enabled.
+func (opts *DriverCollectorOpts) durationLabels() []string {
+	labels := append([]string{}, driverCollectorDurationLabels...)
+	if opts.ClassifyStatements {
+		labels = append(labels, "verb", "table")
+	}
+	if opts.Fingerprint {
+		labels = append(labels, "fingerprint")
+	}
+	return labels
 }
 
 func NewDriverCollector(driver driver.Driver, opts DriverCollectorOpts) *DriverCollector {
@@ -48,10 +165,42 @@ func NewDriverCollector(driver driver.Driver, opts DriverCollectorOpts) *DriverC
 		prefix += "_"
 	}
 
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+
+	lifetimeBuckets := opts.ConnectionLifetimeBuckets
+	if lifetimeBuckets == nil {
+		lifetimeBuckets = defaultConnectionLifetimeBuckets
+	}
+
+	transactionBuckets := opts.TransactionBuckets
+	if transactionBuckets == nil {
+		transactionBuckets = defaultTransactionBuckets
+	}
+
+	rowsBuckets := opts.RowsBuckets
+	if rowsBuckets == nil {
+		rowsBuckets = defaultRowsBuckets
+	}
+
+	var fingerprints *fingerprintSet
+	if opts.Fingerprint {
+		fingerprints = newFingerprintSet(opts.MaxFingerprints)
+	}
+
 	return &DriverCollector{
 		parent:     driver,
 		DriverName: opts.DriverName,
 
+		classifyStatements: opts.ClassifyStatements,
+		fingerprints:       fingerprints,
+		errorClassifier:    opts.ErrorClassifier,
+		leaks:              newLeakTracker(opts),
+		hooks:              opts.Hooks,
+		slowQueries:        newSlowQueryLog(opts.SlowQuery),
+
 		QueryTotalCounter: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: fmt.Sprintf("db_%squery_total", prefix),
 			Help: "The total number of queries processed.",
@@ -100,6 +249,84 @@ func NewDriverCollector(driver driver.Driver, opts DriverCollectorOpts) *DriverC
 			Name: fmt.Sprintf("db_%sexecution_failed", prefix),
 			Help: "The number of executions processed with failure.",
 		}),
+		FailuresCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sfailures_total", prefix),
+			Help: "The number of operations processed with failure, partitioned by error class.",
+		}, driverCollectorFailuresLabels),
+		ConnectionOpenedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sconnection_opened_total", prefix),
+			Help: "The total number of connections opened.",
+		}),
+		ConnectionOpenFailedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sconnection_open_failed", prefix),
+			Help: "The number of connections that failed to open.",
+		}),
+		ConnectionClosedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sconnection_closed_total", prefix),
+			Help: "The total number of connections closed.",
+		}),
+		PingTotalCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sping_total", prefix),
+			Help: "The total number of pings processed.",
+		}),
+		PingFailedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sping_failed", prefix),
+			Help: "The number of pings processed with failure.",
+		}),
+		ResetSessionTotalCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sreset_session_total", prefix),
+			Help: "The total number of session resets processed.",
+		}),
+		ResetSessionFailedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sreset_session_failed", prefix),
+			Help: "The number of session resets processed with failure.",
+		}),
+		TransactionBeginCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%stransaction_begin_total", prefix),
+			Help: "The total number of transactions begun, partitioned by isolation level, read only flag and outcome.",
+		}, driverCollectorTransactionBeginLabels),
+		SlowQueriesCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fmt.Sprintf("db_%sslow_queries_total", prefix),
+			Help: "The number of queries and executions slower than the slow query threshold.",
+		}, driverCollectorSlowQueriesLabels),
+
+		TransactionsInFlightGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("db_%stransaction_in_flight", prefix),
+			Help: "The number of transactions begun but not yet committed or rolled back.",
+		}),
+		OpenRowsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("db_%srows_open", prefix),
+			Help: "The number of result sets (rows cursors) currently open.",
+		}),
+		OpenObjectsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("db_%sopen_objects", prefix),
+			Help: "The number of statements, result sets and transactions currently open.",
+		}, driverCollectorObjectLabels),
+		OldestOpenObjectAgeGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("db_%soldest_open_object_age_seconds", prefix),
+			Help: "The age (in seconds) of the oldest statement, result set and transaction currently open.",
+		}, driverCollectorObjectLabels),
+
+		DurationHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%soperation_duration_seconds", prefix),
+			Help:    "The duration (in seconds) of the operations processed.",
+			Buckets: buckets,
+		}, opts.durationLabels()),
+		ConnectionLifetimeHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%sconnection_lifetime_seconds", prefix),
+			Help:    "The time (in seconds) connections stayed open.",
+			Buckets: lifetimeBuckets,
+		}),
+		TransactionDurationHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%stransaction_duration_seconds", prefix),
+			Help:    "The time (in seconds) from the beginning of the transactions until their commit or rollback.",
+			Buckets: transactionBuckets,
+		}, driverCollectorTransactionDurationLabels),
+		RowsHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%squery_rows", prefix),
+			Help:    "The number of rows read from each query result set.",
+			Buckets: rowsBuckets,
+		}, driverCollectorRowsLabels),
 	}
 }
 
@@ -116,6 +343,24 @@ func (collector *DriverCollector) Describe(descs chan<- *prometheus.Desc) {
 	descs <- collector.ExecutionTotalCounter.Desc()
 	descs <- collector.ExecutionSuccessfulCounter.Desc()
 	descs <- collector.ExecutionFailedCounter.Desc()
+	collector.FailuresCounter.Describe(descs)
+	descs <- collector.ConnectionOpenedCounter.Desc()
+	descs <- collector.ConnectionOpenFailedCounter.Desc()
+	descs <- collector.ConnectionClosedCounter.Desc()
+	descs <- collector.PingTotalCounter.Desc()
+	descs <- collector.PingFailedCounter.Desc()
+	descs <- collector.ResetSessionTotalCounter.Desc()
+	descs <- collector.ResetSessionFailedCounter.Desc()
+	collector.TransactionBeginCounter.Describe(descs)
+	collector.SlowQueriesCounter.Describe(descs)
+	descs <- collector.TransactionsInFlightGauge.Desc()
+	descs <- collector.OpenRowsGauge.Desc()
+	collector.OpenObjectsGauge.Describe(descs)
+	collector.OldestOpenObjectAgeGauge.Describe(descs)
+	collector.DurationHistogram.Describe(descs)
+	descs <- collector.ConnectionLifetimeHistogram.Desc()
+	collector.TransactionDurationHistogram.Describe(descs)
+	collector.RowsHistogram.Describe(descs)
 }
 
 func (collector *DriverCollector) Collect(metrics chan<- prometheus.Metric) {
@@ -131,22 +376,150 @@ func (collector *DriverCollector) Collect(metrics chan<- prometheus.Metric) {
 	collector.ExecutionTotalCounter.Collect(metrics)
 	collector.ExecutionSuccessfulCounter.Collect(metrics)
 	collector.ExecutionFailedCounter.Collect(metrics)
+	collector.FailuresCounter.Collect(metrics)
+	collector.ConnectionOpenedCounter.Collect(metrics)
+	collector.ConnectionOpenFailedCounter.Collect(metrics)
+	collector.ConnectionClosedCounter.Collect(metrics)
+	collector.PingTotalCounter.Collect(metrics)
+	collector.PingFailedCounter.Collect(metrics)
+	collector.ResetSessionTotalCounter.Collect(metrics)
+	collector.ResetSessionFailedCounter.Collect(metrics)
+	collector.TransactionBeginCounter.Collect(metrics)
+	collector.SlowQueriesCounter.Collect(metrics)
+	collector.TransactionsInFlightGauge.Collect(metrics)
+	collector.OpenRowsGauge.Collect(metrics)
+	collector.leaks.update(collector.OpenObjectsGauge, collector.OldestOpenObjectAgeGauge)
+	collector.OpenObjectsGauge.Collect(metrics)
+	collector.OldestOpenObjectAgeGauge.Collect(metrics)
+	collector.DurationHistogram.Collect(metrics)
+	collector.ConnectionLifetimeHistogram.Collect(metrics)
+	collector.TransactionDurationHistogram.Collect(metrics)
+	collector.RowsHistogram.Collect(metrics)
+}
+
+// observe records the duration of the given operation, partitioned by the
+// query name found in `ctx`, its outcome and, when enabled, the statement
+// classification. Failures are also counted by their error class.
+func (collector *DriverCollector) observe(ctx context.Context, op Op, query string, duration time.Duration, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+		collector.FailuresCounter.WithLabelValues(string(op), classifyError(collector.errorClassifier, err)).Inc()
+	}
+
+	lvs := make([]string, 0, 6)
+	lvs = append(lvs, QueryName(ctx), string(op), outcome)
+	// The statement is tokenized once, for both its classification and its
+	// fingerprint.
+	var tokens []token
+	if query != "" && (collector.classifyStatements || collector.fingerprints != nil) {
+		tokens = tokenize(query)
+	}
+	if collector.classifyStatements {
+		verb, table := "", ""
+		if query != "" {
+			verb, table = classifyTokens(tokens)
+		}
+		lvs = append(lvs, verb, table)
+	}
+	if collector.fingerprints != nil {
+		fingerprint := ""
+		if query != "" {
+			fingerprint = collector.fingerprints.bound(fingerprintTokens(tokens, len(query)))
+		}
+		lvs = append(lvs, fingerprint)
+	}
+	collector.DurationHistogram.WithLabelValues(lvs...).Observe(duration.Seconds())
+}
+
+// OpenObjects returns the statements, result sets and transactions open for
+// longer than `olderThan`, oldest first. Their stack traces are only
+// available when DriverCollectorOpts.LeakDebug is enabled.
+func (collector *DriverCollector) OpenObjects(olderThan time.Duration) []OpenObject {
+	return collector.leaks.open(olderThan)
 }
 
 func (d *DriverCollector) Open(name string) (driver.Conn, error) {
-	c, err := d.parent.Open(name)
+	return d.opened(d.parent.Open(name))
+}
+
+// OpenConnector implements driver.DriverContext. If the wrapped driver is a
+// driver.DriverContext, its connector is used. Otherwise, connections are
+// opened by calling the `Open` of the wrapped driver with `name`.
+func (d *DriverCollector) OpenConnector(name string) (driver.Connector, error) {
+	if driverCtx, ok := d.parent.(driver.DriverContext); ok {
+		connector, err := driverCtx.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &ocConnector{parent: connector, collector: d}, nil
+	}
+	return &ocConnector{parent: dsnConnector{dsn: name, driver: d.parent}, collector: d}, nil
+}
+
+// Connect implements driver.Connector for the collectors created by
+// `WrapConnector`, so they can be passed to `sql.OpenDB`.
+func (d *DriverCollector) Connect(ctx context.Context) (driver.Conn, error) {
+	if d.connector == nil {
+		return nil, errNoConnector
+	}
+	return d.opened(d.connector.Connect(ctx))
+}
+
+// Driver implements driver.Connector.
+func (d *DriverCollector) Driver() driver.Driver {
+	return d
+}
+
+// opened counts and wraps a connection opened by the wrapped driver or
+// connector.
+func (d *DriverCollector) opened(c driver.Conn, err error) (driver.Conn, error) {
 	if err != nil {
+		d.ConnectionOpenFailedCounter.Inc()
 		return nil, err
 	}
+	d.ConnectionOpenedCounter.Inc()
 	return wrapConn(c, d), nil
 }
 
+var errNoConnector = errors.New("promsql: the collector does not wrap a driver.Connector, use WrapConnector")
+
+// ocConnector implements driver.Connector
+type ocConnector struct {
+	parent    driver.Connector
+	collector *DriverCollector
+}
+
+func (c *ocConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.collector.opened(c.parent.Connect(ctx))
+}
+
+func (c *ocConnector) Driver() driver.Driver {
+	return c.collector
+}
+
+// dsnConnector is a driver.Connector for drivers that do not implement
+// driver.DriverContext, the same way the `database/sql` package does.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
 func wrapConn(parent driver.Conn, collector *DriverCollector) driver.Conn {
 	var (
 		n, hasNameValueChecker = parent.(driver.NamedValueChecker)
-		s, hasSessionResetter  = parent.(driver.SessionResetter)
+		r, hasSessionResetter  = parent.(driver.SessionResetter)
 	)
-	c := &ocConn{parent: parent, collector: collector}
+	c := &ocConn{parent: parent, collector: collector, openedAt: time.Now()}
+	s := ocSessionResetter{parent: r, collector: collector}
 	switch {
 	case !hasNameValueChecker && !hasSessionResetter:
 		return c
@@ -183,11 +556,15 @@ type conn interface {
 
 var (
 	regMu sync.Mutex
+	// registered keeps the collectors registered by `Register` and
+	// `RegisterAs`, by driver name.
+	registered = make(map[string]*DriverCollector)
 )
 
-func Register(options DriverCollectorOpts) (*DriverCollector, error) {
-	// retrieve the driver implementation we need to wrap with instrumentation
-	db, err := sql.Open(options.DriverName, "")
+// parentDriver retrieves the driver implementation we need to wrap with
+// instrumentation.
+func parentDriver(driverName string) (driver.Driver, error) {
+	db, err := sql.Open(driverName, "")
 	if err != nil {
 		return nil, err
 	}
@@ -195,6 +572,14 @@ func Register(options DriverCollectorOpts) (*DriverCollector, error) {
 	if err = db.Close(); err != nil {
 		return nil, err
 	}
+	return dri, nil
+}
+
+func Register(options DriverCollectorOpts) (*DriverCollector, error) {
+	dri, err := parentDriver(options.DriverName)
+	if err != nil {
+		return nil, err
+	}
 
 	regMu.Lock()
 	defer regMu.Unlock()
@@ -214,16 +599,73 @@ func Register(options DriverCollectorOpts) (*DriverCollector, error) {
 			driverCollector := Wrap(dri, options)
 			sql.Register(regName, driverCollector)
 			driverCollector.DriverName = regName
+			registered[regName] = driverCollector
 			return driverCollector, nil
 		}
 	}
 	return nil, errors.New("unable to register driver, all slots have been taken")
 }
 
+// RegisterAs wraps the `options.DriverName` driver and registers it in the
+// `database/sql` package as `name`.
+//
+// Unlike `Register`, it is idempotent: if `name` was already registered by
+// `RegisterAs`, the existing collector is returned and `options` is ignored.
+// That makes it safe to call from services that can be restarted.
+func RegisterAs(name string, options DriverCollectorOpts) (*DriverCollector, error) {
+	regMu.Lock()
+	defer regMu.Unlock()
+
+	if driverCollector, ok := registered[name]; ok {
+		return driverCollector, nil
+	}
+	for _, driverName := range sql.Drivers() {
+		if driverName == name {
+			return nil, fmt.Errorf("promsql: driver %q is already registered by another package", name)
+		}
+	}
+
+	dri, err := parentDriver(options.DriverName)
+	if err != nil {
+		return nil, err
+	}
+
+	driverCollector := Wrap(dri, options)
+	sql.Register(name, driverCollector)
+	driverCollector.DriverName = name
+	registered[name] = driverCollector
+	return driverCollector, nil
+}
+
+// Lookup returns the collector registered as `name` by `Register` or
+// `RegisterAs`.
+func Lookup(name string) (*DriverCollector, bool) {
+	regMu.Lock()
+	defer regMu.Unlock()
+
+	driverCollector, ok := registered[name]
+	return driverCollector, ok
+}
+
 func Wrap(d driver.Driver, options DriverCollectorOpts) *DriverCollector {
 	return wrapDriver(d, options)
 }
 
+// WrapConnector instruments a driver.Connector, such as the one returned by
+// `pq.NewConnector`, without registering any driver. The returned collector
+// is itself a driver.Connector:
+//
+// ```
+// collector := promsql.WrapConnector(connector, promsql.DriverCollectorOpts{})
+// prometheus.MustRegister(collector)
+// db := sql.OpenDB(collector)
+// ```
+func WrapConnector(c driver.Connector, options DriverCollectorOpts) *DriverCollector {
+	collector := wrapDriver(c.Driver(), options)
+	collector.connector = c
+	return collector
+}
+
 func wrapDriver(d driver.Driver, o DriverCollectorOpts) *DriverCollector {
 	return NewDriverCollector(d, o)
 }
@@ -232,11 +674,20 @@ func wrapDriver(d driver.Driver, o DriverCollectorOpts) *DriverCollector {
 type ocConn struct {
 	parent    driver.Conn
 	collector *DriverCollector
+	openedAt  time.Time
 }
 
 func (c *ocConn) Ping(ctx context.Context) (err error) {
 	if pinger, ok := c.parent.(driver.Pinger); ok {
+		c.collector.PingTotalCounter.Inc()
+
+		ctx = c.collector.before(ctx, OpPing, "", nil)
+		start := time.Now()
 		err = pinger.Ping(ctx)
+		c.collector.after(ctx, OpPing, "", nil, nil, err, start)
+		if err != nil {
+			c.collector.PingFailedCounter.Inc()
+		}
 	}
 	return
 }
@@ -245,7 +696,12 @@ func (c *ocConn) Exec(query string, args []driver.Value) (res driver.Result, err
 	if exec, ok := c.parent.(driver.Execer); ok {
 		c.collector.ExecutionTotalCounter.Inc()
 
-		if res, err = exec.Exec(query, args); err != nil {
+		ctx, named := context.Background(), c.collector.namedValues(args)
+		ctx = c.collector.before(ctx, OpExec, query, named)
+		start := time.Now()
+		res, err = exec.Exec(query, args)
+		c.collector.after(ctx, OpExec, query, named, res, err, start)
+		if err != nil {
 			c.collector.ExecutionFailedCounter.Inc()
 			return nil, err
 		}
@@ -261,7 +717,11 @@ func (c *ocConn) ExecContext(ctx context.Context, query string, args []driver.Na
 	if execCtx, ok := c.parent.(driver.ExecerContext); ok {
 		c.collector.ExecutionTotalCounter.Inc()
 
-		if res, err = execCtx.ExecContext(ctx, query, args); err != nil {
+		ctx = c.collector.before(ctx, OpExec, query, args)
+		start := time.Now()
+		res, err = execCtx.ExecContext(ctx, query, args)
+		c.collector.after(ctx, OpExec, query, args, res, err, start)
+		if err != nil {
 			c.collector.ExecutionFailedCounter.Inc()
 			return nil, err
 		}
@@ -277,7 +737,11 @@ func (c *ocConn) Query(query string, args []driver.Value) (rows driver.Rows, err
 	if queryer, ok := c.parent.(driver.Queryer); ok {
 		c.collector.QueryTotalCounter.Inc()
 
+		ctx, named := context.Background(), c.collector.namedValues(args)
+		ctx = c.collector.before(ctx, OpQuery, query, named)
+		start := time.Now()
 		rows, err = queryer.Query(query, args)
+		c.collector.after(ctx, OpQuery, query, named, rows, err, start)
 		if err != nil {
 
 			c.collector.QueryFailedCounter.Inc()
@@ -285,7 +749,7 @@ func (c *ocConn) Query(query string, args []driver.Value) (rows driver.Rows, err
 		}
 
 		c.collector.QuerySuccessfulCounter.Inc()
-		return rows, nil
+		return wrapRows(ctx, rows, query, c.collector), nil
 	}
 
 	return nil, driver.ErrSkip
@@ -295,7 +759,10 @@ func (c *ocConn) QueryContext(ctx context.Context, query string, args []driver.N
 	if queryerCtx, ok := c.parent.(driver.QueryerContext); ok {
 
 		c.collector.QueryTotalCounter.Inc()
+		ctx = c.collector.before(ctx, OpQuery, query, args)
+		start := time.Now()
 		rows, err = queryerCtx.QueryContext(ctx, query, args)
+		c.collector.after(ctx, OpQuery, query, args, rows, err, start)
 		if err != nil {
 
 			c.collector.QueryFailedCounter.Inc()
@@ -303,7 +770,7 @@ func (c *ocConn) QueryContext(ctx context.Context, query string, args []driver.N
 		}
 
 		c.collector.QuerySuccessfulCounter.Inc()
-		return rows, nil
+		return wrapRows(ctx, rows, query, c.collector), nil
 	}
 
 	return nil, driver.ErrSkip
@@ -315,11 +782,13 @@ func (c *ocConn) Prepare(query string) (stmt driver.Stmt, err error) {
 		return nil, err
 	}
 
-	stmt = wrapStmt(stmt, query, c.collector)
+	stmt = wrapStmt(context.Background(), stmt, query, c.collector)
 	return
 }
 
 func (c *ocConn) Close() error {
+	c.collector.ConnectionClosedCounter.Inc()
+	c.collector.ConnectionLifetimeHistogram.Observe(time.Since(c.openedAt).Seconds())
 	return c.parent.Close()
 }
 
@@ -337,7 +806,7 @@ func (c *ocConn) PrepareContext(ctx context.Context, query string) (stmt driver.
 		return nil, err
 	}
 
-	stmt = wrapStmt(stmt, query, c.collector)
+	stmt = wrapStmt(ctx, stmt, query, c.collector)
 	return
 }
 
@@ -345,19 +814,58 @@ func (c *ocConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.
 	if ctx == nil || ctx == context.TODO() {
 		ctx = context.Background()
 	}
+
+	ctx = c.collector.before(ctx, OpBegin, "", nil)
+	start := time.Now()
 	if connBeginTx, ok := c.parent.(driver.ConnBeginTx); ok {
 		tx, err = connBeginTx.BeginTx(ctx, opts)
-		if err != nil {
-			return nil, err
-		}
-		return ocTx{parent: tx, ctx: ctx, collector: c.collector}, nil
+	} else {
+		tx, err = c.parent.Begin()
 	}
+	c.collector.after(ctx, OpBegin, "", nil, tx, err, start)
 
-	tx, err = c.parent.Begin()
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+	c.collector.TransactionBeginCounter.WithLabelValues(isolationLevelName(opts.Isolation), strconv.FormatBool(opts.ReadOnly), outcome).Inc()
 	if err != nil {
 		return nil, err
 	}
-	return ocTx{parent: tx, ctx: ctx, collector: c.collector}, nil
+
+	c.collector.TransactionsInFlightGauge.Inc()
+	return ocTx{
+		parent:    tx,
+		ctx:       ctx,
+		collector: c.collector,
+		start:     start,
+		leak:      c.collector.leaks.track(ObjectKindTx, QueryName(ctx), ""),
+	}, nil
+}
+
+// isolationLevelName returns the `isolation` label value for the given
+// level, such as "default" or "read_committed". Levels unknown to the
+// `database/sql` package are reported as "other".
+func isolationLevelName(level driver.IsolationLevel) string {
+	if level < 0 || level > driver.IsolationLevel(sql.LevelLinearizable) {
+		return "other"
+	}
+	return strings.Replace(strings.ToLower(sql.IsolationLevel(level).String()), " ", "_", -1)
+}
+
+// ocSessionResetter implements driver.SessionResetter
+type ocSessionResetter struct {
+	parent    driver.SessionResetter
+	collector *DriverCollector
+}
+
+func (r ocSessionResetter) ResetSession(ctx context.Context) (err error) {
+	r.collector.ResetSessionTotalCounter.Inc()
+
+	if err = r.parent.ResetSession(ctx); err != nil {
+		r.collector.ResetSessionFailedCounter.Inc()
+	}
+	return
 }
 
 // ocResult implements driver.Result
@@ -379,12 +887,17 @@ type ocStmt struct {
 	parent    driver.Stmt
 	query     string
 	collector *DriverCollector
+	leak      *trackedObject
 }
 
 func (s ocStmt) Exec(args []driver.Value) (res driver.Result, err error) {
 	s.collector.ExecutionTotalCounter.Inc()
 
+	ctx, named := context.Background(), s.collector.namedValues(args)
+	ctx = s.collector.before(ctx, OpExec, s.query, named)
+	start := time.Now()
 	res, err = s.parent.Exec(args)
+	s.collector.after(ctx, OpExec, s.query, named, res, err, start)
 	if err != nil {
 		s.collector.ExecutionFailedCounter.Inc()
 		return nil, err
@@ -397,6 +910,7 @@ func (s ocStmt) Exec(args []driver.Value) (res driver.Result, err error) {
 }
 
 func (s ocStmt) Close() error {
+	s.collector.leaks.release(s.leak)
 	return s.parent.Close()
 }
 
@@ -407,7 +921,11 @@ func (s ocStmt) NumInput() int {
 func (s ocStmt) Query(args []driver.Value) (rows driver.Rows, err error) {
 	s.collector.QueryTotalCounter.Inc()
 
+	ctx, named := context.Background(), s.collector.namedValues(args)
+	ctx = s.collector.before(ctx, OpQuery, s.query, named)
+	start := time.Now()
 	rows, err = s.parent.Query(args)
+	s.collector.after(ctx, OpQuery, s.query, named, rows, err, start)
 	if err != nil {
 
 		s.collector.QueryFailedCounter.Inc()
@@ -415,14 +933,20 @@ func (s ocStmt) Query(args []driver.Value) (rows driver.Rows, err error) {
 	}
 
 	s.collector.QuerySuccessfulCounter.Inc()
-	return rows, nil
+	return wrapRows(ctx, rows, s.query, s.collector), nil
 }
 
 func (s ocStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
 	s.collector.QueryTotalCounter.Inc()
 
-	queryContext := s.parent.(driver.StmtQueryContext)
-	rows, err = queryContext.QueryContext(ctx, args)
+	ctx = s.collector.before(ctx, OpQuery, s.query, args)
+	start := time.Now()
+	if queryContext, ok := s.parent.(driver.StmtQueryContext); ok {
+		rows, err = queryContext.QueryContext(ctx, args)
+	} else {
+		rows, err = stmtQuery(ctx, s.parent, args)
+	}
+	s.collector.after(ctx, OpQuery, s.query, args, rows, err, start)
 	if err != nil {
 
 		s.collector.QueryFailedCounter.Inc()
@@ -431,15 +955,21 @@ func (s ocStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (row
 	}
 
 	s.collector.QuerySuccessfulCounter.Inc()
-	rows, err = wrapRows(ctx, rows), nil
+	rows, err = wrapRows(ctx, rows, s.query, s.collector), nil
 	return
 }
 
 func (s ocStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (res driver.Result, err error) {
 	s.collector.ExecutionTotalCounter.Inc()
 
-	execContext := s.parent.(driver.StmtExecContext)
-	res, err = execContext.ExecContext(ctx, args)
+	ctx = s.collector.before(ctx, OpExec, s.query, args)
+	start := time.Now()
+	if execContext, ok := s.parent.(driver.StmtExecContext); ok {
+		res, err = execContext.ExecContext(ctx, args)
+	} else {
+		res, err = stmtExec(ctx, s.parent, args)
+	}
+	s.collector.after(ctx, OpExec, s.query, args, res, err, start)
 	if err != nil {
 
 		s.collector.ExecutionFailedCounter.Inc()
@@ -455,12 +985,17 @@ type withRowsColumnTypeScanType interface {
 	ColumnTypeScanType(index int) reflect.Type
 }
 
+// ocRows implements driver.Rows, counting the rows read until it is closed.
 type ocRows struct {
-	parent driver.Rows
-	ctx    context.Context
+	parent    driver.Rows
+	ctx       context.Context
+	collector *DriverCollector
+	leak      *trackedObject
+	count     int
+	closed    bool
 }
 
-func (r ocRows) HasNextResultSet() bool {
+func (r *ocRows) HasNextResultSet() bool {
 	if v, ok := r.parent.(driver.RowsNextResultSet); ok {
 		return v.HasNextResultSet()
 	}
@@ -468,7 +1003,7 @@ func (r ocRows) HasNextResultSet() bool {
 	return false
 }
 
-func (r ocRows) NextResultSet() error {
+func (r *ocRows) NextResultSet() error {
 	if v, ok := r.parent.(driver.RowsNextResultSet); ok {
 		return v.NextResultSet()
 	}
@@ -476,7 +1011,7 @@ func (r ocRows) NextResultSet() error {
 	return io.EOF
 }
 
-func (r ocRows) ColumnTypeDatabaseTypeName(index int) string {
+func (r *ocRows) ColumnTypeDatabaseTypeName(index int) string {
 	if v, ok := r.parent.(driver.RowsColumnTypeDatabaseTypeName); ok {
 		return v.ColumnTypeDatabaseTypeName(index)
 	}
@@ -484,7 +1019,7 @@ func (r ocRows) ColumnTypeDatabaseTypeName(index int) string {
 	return ""
 }
 
-func (r ocRows) ColumnTypeLength(index int) (length int64, ok bool) {
+func (r *ocRows) ColumnTypeLength(index int) (length int64, ok bool) {
 	if v, ok := r.parent.(driver.RowsColumnTypeLength); ok {
 		return v.ColumnTypeLength(index)
 	}
@@ -492,7 +1027,7 @@ func (r ocRows) ColumnTypeLength(index int) (length int64, ok bool) {
 	return 0, false
 }
 
-func (r ocRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+func (r *ocRows) ColumnTypeNullable(index int) (nullable, ok bool) {
 	if v, ok := r.parent.(driver.RowsColumnTypeNullable); ok {
 		return v.ColumnTypeNullable(index)
 	}
@@ -500,7 +1035,7 @@ func (r ocRows) ColumnTypeNullable(index int) (nullable, ok bool) {
 	return false, false
 }
 
-func (r ocRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+func (r *ocRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
 	if v, ok := r.parent.(driver.RowsColumnTypePrecisionScale); ok {
 		return v.ColumnTypePrecisionScale(index)
 	}
@@ -508,31 +1043,43 @@ func (r ocRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok
 	return 0, 0, false
 }
 
-func (r ocRows) Columns() []string {
+func (r *ocRows) Columns() []string {
 	return r.parent.Columns()
 }
 
-func (r ocRows) Close() error {
+func (r *ocRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.collector.leaks.release(r.leak)
+		r.collector.OpenRowsGauge.Dec()
+		r.collector.RowsHistogram.WithLabelValues(QueryName(r.ctx)).Observe(float64(r.count))
+	}
 	return r.parent.Close()
 }
 
-func (r ocRows) Next(dest []driver.Value) error {
-	return r.parent.Next(dest)
+func (r *ocRows) Next(dest []driver.Value) (err error) {
+	if err = r.parent.Next(dest); err == nil {
+		r.count++
+	}
+	return
 }
 
-func wrapRows(ctx context.Context, parent driver.Rows) driver.Rows {
+func wrapRows(ctx context.Context, parent driver.Rows, query string, collector *DriverCollector) driver.Rows {
 	var (
 		ts, hasColumnTypeScan = parent.(driver.RowsColumnTypeScanType)
 	)
 
-	r := ocRows{
-		parent: parent,
-		ctx:    ctx,
+	collector.OpenRowsGauge.Inc()
+	r := &ocRows{
+		parent:    parent,
+		ctx:       ctx,
+		collector: collector,
+		leak:      collector.leaks.track(ObjectKindRows, QueryName(ctx), query),
 	}
 
 	if hasColumnTypeScan {
 		return struct {
-			ocRows
+			*ocRows
 			withRowsColumnTypeScanType
 		}{r, ts}
 	}
@@ -544,12 +1091,25 @@ type ocTx struct {
 	parent    driver.Tx
 	ctx       context.Context
 	collector *DriverCollector
+	start     time.Time
+	leak      *trackedObject
+}
+
+// done records the end of the transaction, started when it was begun.
+func (t ocTx) done(op Op) {
+	t.collector.leaks.release(t.leak)
+	t.collector.TransactionsInFlightGauge.Dec()
+	t.collector.TransactionDurationHistogram.WithLabelValues(string(op)).Observe(time.Since(t.start).Seconds())
 }
 
 func (t ocTx) Commit() (err error) {
 	t.collector.TransactionCommitTotalCounter.Inc()
 
+	ctx := t.collector.before(t.ctx, OpCommit, "", nil)
+	start := time.Now()
 	err = t.parent.Commit()
+	t.collector.after(ctx, OpCommit, "", nil, nil, err, start)
+	t.done(OpCommit)
 	if err != nil {
 		t.collector.TransactionCommitFailedCounter.Inc()
 	} else {
@@ -561,7 +1121,11 @@ func (t ocTx) Commit() (err error) {
 func (t ocTx) Rollback() (err error) {
 	t.collector.TransactionRollbackTotalCounter.Inc()
 
+	ctx := t.collector.before(t.ctx, OpRollback, "", nil)
+	start := time.Now()
 	err = t.parent.Rollback()
+	t.collector.after(ctx, OpRollback, "", nil, nil, err, start)
+	t.done(OpRollback)
 	if err != nil {
 		t.collector.TransactionRollbackFailedCounter.Inc()
 	} else {
@@ -570,106 +1134,43 @@ func (t ocTx) Rollback() (err error) {
 	return err
 }
 
-func wrapStmt(stmt driver.Stmt, query string, collector *DriverCollector) driver.Stmt {
+// wrapStmt always exposes driver.StmtExecContext and driver.StmtQueryContext,
+// even when the parent statement does not implement them, so the context of
+// the calls (and the query name it carries) reaches the collector.
+func wrapStmt(ctx context.Context, stmt driver.Stmt, query string, collector *DriverCollector) driver.Stmt {
 	var (
-		_, hasExeCtx    = stmt.(driver.StmtExecContext)
-		_, hasQryCtx    = stmt.(driver.StmtQueryContext)
 		c, hasColConv   = stmt.(driver.ColumnConverter)
 		n, hasNamValChk = stmt.(driver.NamedValueChecker)
 	)
 
-	s := ocStmt{parent: stmt, query: query, collector: collector}
+	s := ocStmt{
+		parent:    stmt,
+		query:     query,
+		collector: collector,
+		leak:      collector.leaks.track(ObjectKindStmt, QueryName(ctx), query),
+	}
 	switch {
-	case !hasExeCtx && !hasQryCtx && !hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-		}{s}
-	case !hasExeCtx && hasQryCtx && !hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtQueryContext
-		}{s, s}
-	case hasExeCtx && !hasQryCtx && !hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtExecContext
-		}{s, s}
-	case hasExeCtx && hasQryCtx && !hasColConv && !hasNamValChk:
+	case !hasColConv && !hasNamValChk:
 		return struct {
 			driver.Stmt
 			driver.StmtExecContext
 			driver.StmtQueryContext
 		}{s, s, s}
-	case !hasExeCtx && !hasQryCtx && hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.ColumnConverter
-		}{s, c}
-	case !hasExeCtx && hasQryCtx && hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtQueryContext
-			driver.ColumnConverter
-		}{s, s, c}
-	case hasExeCtx && !hasQryCtx && hasColConv && !hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtExecContext
-			driver.ColumnConverter
-		}{s, s, c}
-	case hasExeCtx && hasQryCtx && hasColConv && !hasNamValChk:
+	case hasColConv && !hasNamValChk:
 		return struct {
 			driver.Stmt
 			driver.StmtExecContext
 			driver.StmtQueryContext
 			driver.ColumnConverter
 		}{s, s, s, c}
-
-	case !hasExeCtx && !hasQryCtx && !hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.NamedValueChecker
-		}{s, n}
-	case !hasExeCtx && hasQryCtx && !hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtQueryContext
-			driver.NamedValueChecker
-		}{s, s, n}
-	case hasExeCtx && !hasQryCtx && !hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtExecContext
-			driver.NamedValueChecker
-		}{s, s, n}
-	case hasExeCtx && hasQryCtx && !hasColConv && hasNamValChk:
+	case !hasColConv && hasNamValChk:
 		return struct {
 			driver.Stmt
 			driver.StmtExecContext
 			driver.StmtQueryContext
 			driver.NamedValueChecker
 		}{s, s, s, n}
-	case !hasExeCtx && !hasQryCtx && hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.ColumnConverter
-			driver.NamedValueChecker
-		}{s, c, n}
-	case !hasExeCtx && hasQryCtx && hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtQueryContext
-			driver.ColumnConverter
-			driver.NamedValueChecker
-		}{s, s, c, n}
-	case hasExeCtx && !hasQryCtx && hasColConv && hasNamValChk:
-		return struct {
-			driver.Stmt
-			driver.StmtExecContext
-			driver.ColumnConverter
-			driver.NamedValueChecker
-		}{s, s, c, n}
-	case hasExeCtx && hasQryCtx && hasColConv && hasNamValChk:
+	case hasColConv && hasNamValChk:
 		return struct {
 			driver.Stmt
 			driver.StmtExecContext
@@ -681,4 +1182,47 @@ func wrapStmt(stmt driver.Stmt, query string, collector *DriverCollector) driver
 	panic("unreachable")
 }
 
+// stmtQuery mimics what the `database/sql` package does for statements that
+// do not implement driver.StmtQueryContext.
+func stmtQuery(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Rows, error) {
+	dargs, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return stmt.Query(dargs)
+}
+
+// stmtExec mimics what the `database/sql` package does for statements that
+// do not implement driver.StmtExecContext.
+func stmtExec(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Result, error) {
+	dargs, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return stmt.Exec(dargs)
+}
+
+func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
+	dargs := make([]driver.Value, len(named))
+	for n, param := range named {
+		if len(param.Name) > 0 {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		dargs[n] = param.Value
+	}
+	return dargs, nil
+}
+
 var errConnDone = sql.ErrConnDone
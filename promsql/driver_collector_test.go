@@ -3,11 +3,14 @@ package promsql_test
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/lab259/go-rscsrv-prometheus/ginkgotest"
@@ -693,3 +696,550 @@ var _ = Describe("Driver Collector", func() {
 		})
 	})
 })
+
+var _ = Describe("Driver Collector durations", func() {
+	It("should observe query durations partitioned by outcome", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 1}, promsql.DriverCollectorOpts{
+			Buckets: []float64{0.1, 1},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		rs, err := db.Query("select name from users")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rs.Close()).To(Succeed())
+
+		_, err = db.Query("fail")
+		Expect(err).Should(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "query", "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(metric.GetHistogram().GetBucket()).To(HaveLen(2))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "query", "failure").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should observe execution and transaction durations", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Commit()).To(Succeed())
+
+		tx, err = db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Rollback()).To(Succeed())
+
+		var metric dto.Metric
+		for _, operation := range []string{"exec", "commit", "rollback"} {
+			Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", operation, "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+			Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		}
+	})
+
+	It("should use the query name from the context", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 1}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		ctx := promsql.WithQueryName(context.Background(), "fetch_users")
+		rs, err := db.QueryContext(ctx, "select name from users")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rs.Close()).To(Succeed())
+
+		stmt, err := db.PrepareContext(ctx, "update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer stmt.Close()
+		_, err = stmt.ExecContext(promsql.WithQueryName(context.Background(), "update_users"))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(driverCollector.DurationHistogram.WithLabelValues("fetch_users", "query", "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("update_users", "exec", "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "query", "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(0))
+	})
+
+	It("should classify and fingerprint statements", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 1}, promsql.DriverCollectorOpts{
+			ClassifyStatements: true,
+			Fingerprint:        true,
+			MaxFingerprints:    1,
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		_, err := db.Exec("UPDATE users SET name = 'john' WHERE id = 1")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.Exec("DELETE FROM users WHERE id = 1")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "exec", "success", "update", "users", "update users set name = ? where id = ?").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "exec", "success", "delete", "users", promsql.OtherFingerprint).(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should count failures by error class", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{
+			ErrorClassifier: func(err error) string {
+				if err == errFakeQuery {
+					return "fake"
+				}
+				return ""
+			},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		_, err := db.Exec("fail")
+		Expect(err).Should(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(driverCollector.FailuresCounter.WithLabelValues("exec", "fake").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ExecutionFailedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should classify standard library errors", func() {
+		Expect(promsql.DefaultErrorClassifier(driver.ErrBadConn)).To(Equal(promsql.ErrorClassBadConnection))
+		Expect(promsql.DefaultErrorClassifier(context.Canceled)).To(Equal(promsql.ErrorClassCanceled))
+		Expect(promsql.DefaultErrorClassifier(context.DeadlineExceeded)).To(Equal(promsql.ErrorClassDeadlineExceeded))
+		Expect(promsql.DefaultErrorClassifier(sql.ErrTxDone)).To(Equal(promsql.ErrorClassTxDone))
+		Expect(promsql.DefaultErrorClassifier(errFakeQuery)).To(Equal(promsql.ErrorClassOther))
+	})
+})
+
+var _ = Describe("Driver Collector connections", func() {
+	It("should count opened and closed connections", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+
+		Expect(db.Ping()).To(Succeed())
+		_, err := db.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(db.Close()).To(Succeed())
+
+		var metric dto.Metric
+		Expect(driverCollector.ConnectionOpenedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ConnectionClosedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ConnectionLifetimeHistogram.Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(driverCollector.PingTotalCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ResetSessionTotalCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "ping", "success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should count connections that failed to open", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := sql.OpenDB(&fakeConnector{name: "fail", driver: driverCollector})
+		defer db.Close()
+
+		Expect(db.Ping()).To(MatchError(errFakeQuery))
+
+		var metric dto.Metric
+		Expect(driverCollector.ConnectionOpenFailedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ConnectionOpenedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(0))
+	})
+})
+
+var _ = Describe("Driver Collector transactions", func() {
+	It("should count begun transactions by isolation level and read only flag", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Commit()).To(Succeed())
+
+		_, err = db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelLinearizable})
+		Expect(err).To(MatchError(errFakeQuery))
+
+		var metric dto.Metric
+		Expect(driverCollector.TransactionBeginCounter.WithLabelValues("read_committed", "true", "success").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.TransactionBeginCounter.WithLabelValues("linearizable", "false", "failure").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.DurationHistogram.WithLabelValues("unnamed", "begin", "failure").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should track transactions in flight and their duration", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		var metric dto.Metric
+		tx1, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		tx2, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(driverCollector.TransactionsInFlightGauge.Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(2))
+
+		Expect(tx1.Commit()).To(Succeed())
+		Expect(tx2.Rollback()).To(Succeed())
+		Expect(driverCollector.TransactionsInFlightGauge.Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(0))
+
+		Expect(driverCollector.TransactionDurationHistogram.WithLabelValues("commit").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(driverCollector.TransactionDurationHistogram.WithLabelValues("rollback").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should include the begin of the transaction in its duration", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{beginDelay: 50 * time.Millisecond}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Commit()).To(Succeed())
+
+		var metric dto.Metric
+		Expect(driverCollector.TransactionDurationHistogram.WithLabelValues("commit").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleSum()).To(BeNumerically(">=", 0.05))
+	})
+})
+
+var _ = Describe("Driver Collector rows", func() {
+	It("should observe the number of rows read per query", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 3}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		var metric dto.Metric
+		rows, err := db.QueryContext(promsql.WithQueryName(context.Background(), "fetch_users"), "select id from users")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(driverCollector.OpenRowsGauge.Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(1))
+
+		count := 0
+		for rows.Next() {
+			count++
+		}
+		Expect(rows.Err()).ShouldNot(HaveOccurred())
+		Expect(count).To(Equal(3))
+		Expect(rows.Close()).To(Succeed())
+
+		Expect(driverCollector.OpenRowsGauge.Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(0))
+		Expect(driverCollector.RowsHistogram.WithLabelValues("fetch_users").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(metric.GetHistogram().GetSampleSum()).To(BeEquivalentTo(3))
+	})
+
+	It("should count the rows of prepared statements", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 2}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		stmt, err := db.Prepare("select id from users")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer stmt.Close()
+
+		var id int64
+		Expect(stmt.QueryRow().Scan(&id)).To(Succeed())
+
+		var metric dto.Metric
+		Expect(driverCollector.OpenRowsGauge.Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(0))
+		Expect(driverCollector.RowsHistogram.WithLabelValues("unnamed").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleSum()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Driver Collector leaks", func() {
+	It("should report the objects left open", func() {
+		var leaked []promsql.OpenObject
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 1}, promsql.DriverCollectorOpts{
+			LeakDebug:     true,
+			LeakThreshold: time.Nanosecond,
+			OnLeak: func(obj promsql.OpenObject) {
+				leaked = append(leaked, obj)
+			},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		tx, err := db.BeginTx(promsql.WithQueryName(context.Background(), "leaky_tx"), nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		rows, err := db.Query("select id from users")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		objects := driverCollector.OpenObjects(0)
+		Expect(objects).To(HaveLen(2))
+		Expect(objects[0].Kind).To(Equal(promsql.ObjectKindTx))
+		Expect(objects[0].Name).To(Equal("leaky_tx"))
+		Expect(string(objects[0].Stack)).To(ContainSubstring("driver_collector_test.go"))
+		Expect(objects[1].Kind).To(Equal(promsql.ObjectKindRows))
+		Expect(objects[1].Query).To(Equal("select id from users"))
+		Expect(driverCollector.OpenObjects(time.Hour)).To(BeEmpty())
+
+		registry := prometheus.NewRegistry()
+		Expect(registry.Register(driverCollector)).To(Succeed())
+		_, err = registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(leaked).To(HaveLen(2))
+
+		var metric dto.Metric
+		Expect(driverCollector.OpenObjectsGauge.WithLabelValues(promsql.ObjectKindRows).Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.OldestOpenObjectAgeGauge.WithLabelValues(promsql.ObjectKindTx).Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeNumerically(">", 0))
+
+		// Objects are reported only once.
+		_, err = registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(leaked).To(HaveLen(2))
+
+		Expect(rows.Close()).To(Succeed())
+		Expect(tx.Rollback()).To(Succeed())
+		Expect(driverCollector.OpenObjects(0)).To(BeEmpty())
+
+		_, err = registry.Gather()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(driverCollector.OpenObjectsGauge.WithLabelValues(promsql.ObjectKindTx).Write(&metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeEquivalentTo(0))
+	})
+
+	It("should track prepared statements until they are closed", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		stmt, err := db.Prepare("update users set name = $1")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = stmt.Exec("john")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		objects := driverCollector.OpenObjects(0)
+		Expect(objects).To(HaveLen(1))
+		Expect(objects[0].Kind).To(Equal(promsql.ObjectKindStmt))
+		Expect(objects[0].Stack).To(BeNil())
+
+		Expect(stmt.Close()).To(Succeed())
+		Expect(driverCollector.OpenObjects(0)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Driver Collector connectors", func() {
+	It("should instrument a connector", func() {
+		driverCollector := promsql.WrapConnector(&fakeConnector{driver: &fakeDriver{}}, promsql.DriverCollectorOpts{})
+		db := sql.OpenDB(driverCollector)
+		defer db.Close()
+
+		_, err := db.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(db.Driver()).To(BeIdenticalTo(driverCollector))
+
+		var metric dto.Metric
+		Expect(driverCollector.ConnectionOpenedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(driverCollector.ExecutionTotalCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should fail to connect when not wrapping a connector", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		_, err := driverCollector.Connect(context.Background())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should implement driver.DriverContext", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{})
+		connector, err := driverCollector.OpenConnector("fail")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(connector.Driver()).To(BeIdenticalTo(driverCollector))
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+		Expect(db.Ping()).To(MatchError(errFakeQuery))
+
+		var metric dto.Metric
+		Expect(driverCollector.ConnectionOpenFailedCounter.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Driver Collector registration", func() {
+	It("should reuse the collector registered with the same name", func() {
+		driverCollector, err := promsql.RegisterAs("postgres-register-as", promsql.DriverCollectorOpts{
+			DriverName: "postgres",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(driverCollector.DriverName).To(Equal("postgres-register-as"))
+		Expect(sql.Drivers()).To(ContainElement("postgres-register-as"))
+
+		again, err := promsql.RegisterAs("postgres-register-as", promsql.DriverCollectorOpts{
+			DriverName: "postgres",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(again).To(BeIdenticalTo(driverCollector))
+
+		found, ok := promsql.Lookup("postgres-register-as")
+		Expect(ok).To(BeTrue())
+		Expect(found).To(BeIdenticalTo(driverCollector))
+	})
+
+	It("should look up the collectors created by Register", func() {
+		driverCollector, err := promsql.Register(promsql.DriverCollectorOpts{
+			DriverName: "postgres",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		found, ok := promsql.Lookup(driverCollector.DriverName)
+		Expect(ok).To(BeTrue())
+		Expect(found).To(BeIdenticalTo(driverCollector))
+
+		_, ok = promsql.Lookup("unknown-driver")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should fail when the name was registered by another package", func() {
+		_, err := promsql.RegisterAs("postgres", promsql.DriverCollectorOpts{
+			DriverName: "postgres",
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Driver Collector hooks", func() {
+	It("should call the hooks around every operation", func() {
+		var calls []hookCall
+		driverCollector := promsql.Wrap(&fakeDriver{rows: 1}, promsql.DriverCollectorOpts{
+			Hooks: &recordingHooks{name: "recorder", calls: &calls},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("update users set name = $1", "john")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Commit()).To(Succeed())
+		_, err = db.Query("select fail")
+		Expect(err).To(MatchError(errFakeQuery))
+
+		Expect(calls).To(HaveLen(8))
+		for i, call := range calls {
+			if i%2 == 0 {
+				Expect(call.stage).To(Equal("before"))
+			} else {
+				Expect(call.stage).To(Equal("after"))
+			}
+		}
+		Expect(calls[0].op).To(Equal(promsql.OpBegin))
+		Expect(calls[2].op).To(Equal(promsql.OpExec))
+		Expect(calls[2].query).To(Equal("update users set name = $1"))
+		Expect(calls[2].args).To(HaveLen(1))
+		Expect(calls[2].args[0].Value).To(Equal("john"))
+		Expect(calls[4].op).To(Equal(promsql.OpCommit))
+		Expect(calls[7].op).To(Equal(promsql.OpQuery))
+		Expect(calls[7].err).To(MatchError(errFakeQuery))
+	})
+
+	It("should chain hooks like nested middlewares", func() {
+		var calls []hookCall
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{
+			Hooks: promsql.ChainHooks(
+				&recordingHooks{name: "outer", calls: &calls},
+				nil,
+				&recordingHooks{name: "inner", calls: &calls},
+			),
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		_, err := db.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(calls).To(HaveLen(4))
+		Expect([]string{calls[0].hook, calls[1].hook, calls[2].hook, calls[3].hook}).To(Equal([]string{"outer", "inner", "inner", "outer"}))
+		Expect([]string{calls[0].stage, calls[1].stage, calls[2].stage, calls[3].stage}).To(Equal([]string{"before", "before", "after", "after"}))
+	})
+})
+
+type linesLogger []string
+
+func (l *linesLogger) Println(v ...interface{}) {
+	*l = append(*l, fmt.Sprint(v...))
+}
+
+var _ = Describe("Driver Collector slow queries", func() {
+	It("should log slow queries with their arguments hashed", func() {
+		var (
+			logger   linesLogger
+			reported []promsql.SlowQuery
+		)
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{
+			SlowQuery: promsql.SlowQueryOpts{
+				Threshold:    time.Nanosecond,
+				Logger:       &logger,
+				ArgsRedactor: promsql.HashArgs,
+				Callback: func(q promsql.SlowQuery) {
+					reported = append(reported, q)
+				},
+			},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		ctx := promsql.WithQueryName(context.Background(), "update_users")
+		_, err := db.ExecContext(ctx, "update users set name = $1 where id = $2", "john", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.ExecContext(ctx, "update fail")
+		Expect(err).To(MatchError(errFakeQuery))
+
+		Expect(reported).To(HaveLen(2))
+		Expect(reported[0].Name).To(Equal("update_users"))
+		Expect(reported[0].Args).To(HaveLen(2))
+		Expect(reported[0].Args[0]).To(HaveLen(12))
+		Expect(reported[0].Args[0]).To(Equal(promsql.HashArgs([]interface{}{"john"})[0]))
+		Expect(reported[0].Args[1]).To(Equal("NULL"))
+		Expect(reported[1].Err).To(MatchError(errFakeQuery))
+
+		Expect(logger).To(HaveLen(2))
+		Expect(logger[0]).To(HavePrefix(`slow query: name=update_users duration=`))
+		Expect(logger[0]).ToNot(ContainSubstring("john"))
+		Expect(logger[1]).To(HaveSuffix(`error="fake query failed"`))
+
+		var metric dto.Metric
+		Expect(driverCollector.SlowQueriesCounter.WithLabelValues("update_users").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+	})
+
+	It("should not report fast queries", func() {
+		driverCollector := promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{
+			SlowQuery: promsql.SlowQueryOpts{
+				Threshold: time.Hour,
+				Callback: func(q promsql.SlowQuery) {
+					Fail("unexpected slow query")
+				},
+			},
+		})
+		db := openFakeDB(driverCollector)
+		defer db.Close()
+
+		_, err := db.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
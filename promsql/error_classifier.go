@@ -0,0 +1,72 @@
+package promsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+)
+
+// Error classes reported by the `error` label of the failure counters.
+const (
+	ErrorClassBadConnection    = "bad_connection"
+	ErrorClassCanceled         = "canceled"
+	ErrorClassDeadlineExceeded = "deadline_exceeded"
+	ErrorClassTxDone           = "tx_done"
+	ErrorClassNoRows           = "no_rows"
+	ErrorClassOther            = "other"
+)
+
+// ErrorClassifier maps an error to a class, used as the `error` label of the
+// failure counters. The returned classes must be bounded, as each one of
+// them becomes a new time series.
+//
+// If the classifier cannot classify the error, it should return an empty
+// string so the built-in classes are used instead.
+type ErrorClassifier func(err error) string
+
+// ChainErrorClassifiers returns an ErrorClassifier that tries each one of
+// the given classifiers, in order, returning the first non empty class.
+func ChainErrorClassifiers(classifiers ...ErrorClassifier) ErrorClassifier {
+	return func(err error) string {
+		for _, classifier := range classifiers {
+			if classifier == nil {
+				continue
+			}
+			if class := classifier(err); class != "" {
+				return class
+			}
+		}
+		return ""
+	}
+}
+
+// DefaultErrorClassifier classifies the errors defined by the standard
+// library: `driver.ErrBadConn`, `context.Canceled`,
+// `context.DeadlineExceeded`, `sql.ErrTxDone` and `sql.ErrNoRows`. Any other
+// error is reported as ErrorClassOther.
+func DefaultErrorClassifier(err error) string {
+	switch err {
+	case driver.ErrBadConn:
+		return ErrorClassBadConnection
+	case context.Canceled:
+		return ErrorClassCanceled
+	case context.DeadlineExceeded:
+		return ErrorClassDeadlineExceeded
+	case sql.ErrTxDone:
+		return ErrorClassTxDone
+	case sql.ErrNoRows:
+		return ErrorClassNoRows
+	}
+	return ErrorClassOther
+}
+
+// classifyError uses the given classifier, falling back to the
+// DefaultErrorClassifier when it is nil or cannot classify the error.
+func classifyError(classifier ErrorClassifier, err error) string {
+	if classifier != nil {
+		if class := classifier(err); class != "" {
+			return class
+		}
+	}
+	return DefaultErrorClassifier(err)
+}
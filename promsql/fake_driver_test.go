@@ -0,0 +1,223 @@
+package promsql_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+// errFakeQuery is returned by the fake driver whenever a statement contains
+// the word "fail".
+var errFakeQuery = errors.New("fake query failed")
+
+// fakeDriver is a minimal in-memory driver.Driver used to exercise the driver
+// wrapper without a running database. Every query returns `rows` rows with a
+// single column, unless `columns` and `values` are set. Statements containing
+// the word "sleep" block until their context is done, and executions of
+// statements containing the word "create" do not report the rows affected.
+// Transactions take `beginDelay` to begin.
+type fakeDriver struct {
+	rows       int
+	columns    []string
+	values     [][]driver.Value
+	queries    int64
+	beginDelay time.Duration
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	if strings.Contains(name, "fail") {
+		return nil, errFakeQuery
+	}
+	return &fakeConn{driver: d}, nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errFakeQuery
+	}
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return &fakeTx{}, nil
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	time.Sleep(c.driver.beginDelay)
+	if opts.Isolation == driver.IsolationLevel(sql.LevelLinearizable) {
+		return nil, errFakeQuery
+	}
+	return &fakeTx{}, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeConn) ResetSession(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&c.driver.queries, 1)
+	if strings.Contains(query, "fail") {
+		return nil, errFakeQuery
+	}
+	if strings.Contains(query, "sleep") {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if c.driver.columns != nil {
+		return &fakeTableRows{columns: c.driver.columns, values: c.driver.values}, nil
+	}
+	return &fakeRows{remaining: c.driver.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errFakeQuery
+	}
+	if strings.Contains(query, "create") {
+		return driver.ResultNoRows, nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, nil)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, nil)
+}
+
+type fakeTx struct{}
+
+func (*fakeTx) Commit() error {
+	return nil
+}
+
+func (*fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeRows struct {
+	remaining int
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.remaining <= 0 {
+		return io.EOF
+	}
+	r.remaining--
+	dest[0] = int64(r.remaining)
+	return nil
+}
+
+type fakeTableRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeTableRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeTableRows) Close() error {
+	return nil
+}
+
+func (r *fakeTableRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// fakeConnector opens connections through the given driver so a wrapped
+// driver can be used with sql.OpenDB without registering it globally.
+type fakeConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func openFakeDB(d driver.Driver) *sql.DB {
+	return sql.OpenDB(&fakeConnector{driver: d})
+}
+
+type hookCall struct {
+	hook  string
+	stage string
+	op    promsql.Op
+	query string
+	args  []driver.NamedValue
+	err   error
+}
+
+// recordingHooks is a promsql.DriverHooks that records every call it
+// receives in `calls`.
+type recordingHooks struct {
+	name  string
+	calls *[]hookCall
+}
+
+type recordingHooksKey struct{}
+
+func (h *recordingHooks) Before(ctx context.Context, op promsql.Op, query string, args []driver.NamedValue) context.Context {
+	*h.calls = append(*h.calls, hookCall{hook: h.name, stage: "before", op: op, query: query, args: args})
+	return context.WithValue(ctx, recordingHooksKey{}, h.name)
+}
+
+func (h *recordingHooks) After(ctx context.Context, op promsql.Op, query string, args []driver.NamedValue, result interface{}, err error, duration time.Duration) {
+	stage := "after"
+	if ctx.Value(recordingHooksKey{}) == nil {
+		stage = "after without context"
+	}
+	*h.calls = append(*h.calls, hookCall{hook: h.name, stage: stage, op: op, query: query, args: args, err: err})
+}
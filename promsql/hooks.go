@@ -0,0 +1,105 @@
+package promsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+)
+
+// Op identifies an operation performed through the `DriverCollector`. It is
+// also reported by the `operation` label of the duration histogram.
+type Op string
+
+// Operations performed through the `DriverCollector`.
+const (
+	OpQuery    Op = "query"
+	OpExec     Op = "exec"
+	OpBegin    Op = "begin"
+	OpCommit   Op = "commit"
+	OpRollback Op = "rollback"
+	OpPing     Op = "ping"
+)
+
+// DriverHooks is called around every operation performed through the
+// `DriverCollector`, on top of the built-in metrics.
+//
+// `query` is empty for the operations that are not statements (begin,
+// commit, rollback and ping) and `args` is nil for the ones without
+// arguments.
+type DriverHooks interface {
+	// Before is called before the operation is sent to the driver. The
+	// context returned is the one passed to the driver, when it supports
+	// contexts, and to `After`. So, it can carry any state the hook needs.
+	Before(ctx context.Context, op Op, query string, args []driver.NamedValue) context.Context
+
+	// After is called once the operation is done. `result` is the
+	// driver.Rows of queries, the driver.Result of executions, the
+	// driver.Tx of begins and nil otherwise.
+	After(ctx context.Context, op Op, query string, args []driver.NamedValue, result interface{}, err error, duration time.Duration)
+}
+
+type hooksChain []DriverHooks
+
+// ChainHooks composes several DriverHooks into one. `Before` is called in
+// the given order, while `After` is called in the reverse order, just like
+// nested middlewares.
+func ChainHooks(hooks ...DriverHooks) DriverHooks {
+	chain := make(hooksChain, 0, len(hooks))
+	for _, h := range hooks {
+		if h != nil {
+			chain = append(chain, h)
+		}
+	}
+	return chain
+}
+
+func (chain hooksChain) Before(ctx context.Context, op Op, query string, args []driver.NamedValue) context.Context {
+	for _, h := range chain {
+		ctx = h.Before(ctx, op, query, args)
+	}
+	return ctx
+}
+
+func (chain hooksChain) After(ctx context.Context, op Op, query string, args []driver.NamedValue, result interface{}, err error, duration time.Duration) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].After(ctx, op, query, args, result, err, duration)
+	}
+}
+
+// before calls the `Before` hook, if any, returning the context to be used
+// by the operation.
+func (collector *DriverCollector) before(ctx context.Context, op Op, query string, args []driver.NamedValue) context.Context {
+	if collector.hooks == nil {
+		return ctx
+	}
+	return collector.hooks.Before(ctx, op, query, args)
+}
+
+// after records the built-in metrics of an operation started at `start`,
+// reports it to the slow query log, when slow, and calls the `After` hook, if
+// any.
+func (collector *DriverCollector) after(ctx context.Context, op Op, query string, args []driver.NamedValue, result interface{}, err error, start time.Time) {
+	duration := time.Since(start)
+	collector.observe(ctx, op, query, duration, err)
+	if query != "" && collector.slowQueries.isSlow(duration) {
+		name := QueryName(ctx)
+		collector.SlowQueriesCounter.WithLabelValues(name).Inc()
+		collector.slowQueries.report(name, query, namedValuesToInterfaces(args), duration, err)
+	}
+	if collector.hooks != nil {
+		collector.hooks.After(ctx, op, query, args, result, err, duration)
+	}
+}
+
+// namedValues converts the arguments of the methods without context, only
+// when there are hooks or a slow query log to receive them.
+func (collector *DriverCollector) namedValues(args []driver.Value) []driver.NamedValue {
+	if collector.hooks == nil && collector.slowQueries == nil || args == nil {
+		return nil
+	}
+	named := make([]driver.NamedValue, len(args))
+	for i, value := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: value}
+	}
+	return named
+}
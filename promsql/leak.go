@@ -0,0 +1,158 @@
+package promsql
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of objects reported by the `kind` label of the open objects gauges.
+const (
+	ObjectKindStmt = "stmt"
+	ObjectKindRows = "rows"
+	ObjectKindTx   = "tx"
+)
+
+var objectKinds = []string{ObjectKindStmt, ObjectKindRows, ObjectKindTx}
+
+var driverCollectorObjectLabels = []string{"kind"}
+
+// defaultLeakThreshold is the age after which an open object is reported to
+// the DriverCollectorOpts.OnLeak callback when no threshold is set.
+const defaultLeakThreshold = time.Minute
+
+// OpenObject describes a statement, result set or transaction created through
+// the `DriverCollector` that was not closed (or committed/rolled back) yet.
+type OpenObject struct {
+	// Kind is one of ObjectKindStmt, ObjectKindRows or ObjectKindTx.
+	Kind string
+	// Name is the query name found in the context used to create the
+	// object. See `WithQueryName`.
+	Name string
+	// Query is the statement that created the object. It is empty for
+	// transactions.
+	Query string
+	// OpenedAt is when the object was created.
+	OpenedAt time.Time
+	// Stack is the stack trace of the goroutine that created the object. It
+	// is only captured when DriverCollectorOpts.LeakDebug is enabled.
+	Stack []byte
+}
+
+// Age returns how long the object has been open.
+func (o OpenObject) Age() time.Duration {
+	return time.Since(o.OpenedAt)
+}
+
+type trackedObject struct {
+	OpenObject
+	reported bool
+}
+
+// leakTracker keeps the objects currently open so the oldest ones can be
+// reported.
+type leakTracker struct {
+	mu        sync.Mutex
+	debug     bool
+	threshold time.Duration
+	onLeak    func(OpenObject)
+	objects   map[*trackedObject]struct{}
+}
+
+func newLeakTracker(opts DriverCollectorOpts) *leakTracker {
+	threshold := opts.LeakThreshold
+	if threshold <= 0 {
+		threshold = defaultLeakThreshold
+	}
+	return &leakTracker{
+		debug:     opts.LeakDebug,
+		threshold: threshold,
+		onLeak:    opts.OnLeak,
+		objects:   make(map[*trackedObject]struct{}),
+	}
+}
+
+// track registers a new open object. The returned object must be passed to
+// `release` once it is closed.
+func (t *leakTracker) track(kind, name, query string) *trackedObject {
+	obj := &trackedObject{
+		OpenObject: OpenObject{
+			Kind:     kind,
+			Name:     name,
+			Query:    query,
+			OpenedAt: time.Now(),
+		},
+	}
+	if t.debug {
+		obj.Stack = debug.Stack()
+	}
+
+	t.mu.Lock()
+	t.objects[obj] = struct{}{}
+	t.mu.Unlock()
+	return obj
+}
+
+// release forgets an object. Releasing it more than once is a no-op.
+func (t *leakTracker) release(obj *trackedObject) {
+	t.mu.Lock()
+	delete(t.objects, obj)
+	t.mu.Unlock()
+}
+
+// open returns the objects open for longer than `olderThan`, oldest first.
+func (t *leakTracker) open(olderThan time.Duration) []OpenObject {
+	t.mu.Lock()
+	objects := make([]OpenObject, 0, len(t.objects))
+	for obj := range t.objects {
+		if obj.Age() >= olderThan {
+			objects = append(objects, obj.OpenObject)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].OpenedAt.Before(objects[j].OpenedAt)
+	})
+	return objects
+}
+
+// update sets the open objects gauges and reports the objects that crossed
+// the threshold since the last update to the `onLeak` callback.
+func (t *leakTracker) update(count, age *prometheus.GaugeVec) {
+	var (
+		now    = time.Now()
+		counts = make(map[string]int, len(objectKinds))
+		oldest = make(map[string]time.Time, len(objectKinds))
+		leaked []OpenObject
+	)
+
+	t.mu.Lock()
+	for obj := range t.objects {
+		counts[obj.Kind]++
+		if at, ok := oldest[obj.Kind]; !ok || obj.OpenedAt.Before(at) {
+			oldest[obj.Kind] = obj.OpenedAt
+		}
+		if t.onLeak != nil && !obj.reported && now.Sub(obj.OpenedAt) >= t.threshold {
+			obj.reported = true
+			leaked = append(leaked, obj.OpenObject)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, kind := range objectKinds {
+		count.WithLabelValues(kind).Set(float64(counts[kind]))
+		seconds := 0.0
+		if at, ok := oldest[kind]; ok {
+			seconds = now.Sub(at).Seconds()
+		}
+		age.WithLabelValues(kind).Set(seconds)
+	}
+
+	for _, obj := range leaked {
+		t.onLeak(obj)
+	}
+}
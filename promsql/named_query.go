@@ -1,15 +1,147 @@
 package promsql
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type NamedQuery struct {
-	parent            *QueryCollector
-	name              string
-	TotalCalls        prometheus.Counter
-	TotalDuration     prometheus.Counter
-	TotalSuccess      prometheus.Counter
-	TotalFailures     prometheus.Counter
-	TotalRowsAffected prometheus.Counter
+	parent *QueryCollector
+	name   string
+
+	// curried and pending are the extra labels given to `NewNamedQuery` and
+	// the ones read from the context, respectively. The `NamedQuery` for
+	// each combination of values found in the contexts is kept in children,
+	// and the metrics of this one are the ones of the calls without a
+	// context (see `withoutContext`).
+	curried  prometheus.Labels
+	pending  []string
+	mu       sync.RWMutex
+	children map[string]*NamedQuery
+
+	TotalCalls           prometheus.Counter
+	TotalDuration        prometheus.Counter
+	TotalSuccess         prometheus.Counter
+	TotalFailures        prometheus.Counter
+	TotalFailuresByError *prometheus.CounterVec
+	TotalRowsAffected    prometheus.Counter
+	TotalSlowQueries     prometheus.Counter
+	// TotalNoRows counts the rows scanned by `Row.Scan` that returned
+	// `sql.ErrNoRows`.
+	TotalNoRows prometheus.Counter
+	// TotalTransactions counts the commits and rollbacks of the transactions
+	// begun by `Query.BeginTx`, partitioned by the `operation` (commit or
+	// rollback) and `outcome` labels.
+	TotalTransactions *prometheus.CounterVec
+	// Duration observes the duration of the query, partitioned by the
+	// `outcome` label (success, failure or no_rows).
+	Duration prometheus.ObserverVec
+	// RowsAffected observes the rows affected by each successful execution.
+	RowsAffected prometheus.Observer
+}
+
+// failed counts a failure of the query, also partitioning it by the class of
+// the error.
+func (nq *NamedQuery) failed(err error) {
+	nq.TotalFailures.Inc()
+	nq.TotalFailuresByError.WithLabelValues(classifyError(nq.parent.errorClassifier, err)).Inc()
+}
+
+// outcomeNoRows is the `outcome` of the rows scanned with `sql.ErrNoRows`.
+const outcomeNoRows = "no_rows"
+
+// observe records the duration of the query, reporting it to the slow query
+// log when it is slower than the threshold and to the statement tracker.
+func (nq *NamedQuery) observe(query string, args []interface{}, duration time.Duration, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+	nq.observeOutcome(query, args, duration, outcome, err)
+}
+
+func (nq *NamedQuery) observeOutcome(query string, args []interface{}, duration time.Duration, outcome string, err error) {
+	nq.TotalDuration.Add(duration.Seconds())
+	nq.Duration.WithLabelValues(outcome).Observe(duration.Seconds())
+	if nq.parent.slowQueries.isSlow(duration) {
+		nq.TotalSlowQueries.Inc()
+		nq.parent.slowQueries.report(nq.name, query, args, duration, err)
+	}
+	if nq.parent.statements != nil && query != "" {
+		nq.parent.statements.Observe(query, duration, err)
+	}
+}
+
+// transactionDone counts a commit or a rollback of a transaction.
+func (nq *NamedQuery) transactionDone(operation string, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+	nq.TotalTransactions.WithLabelValues(operation, outcome).Inc()
+}
+
+// forContext returns the `NamedQuery` for the values of the pending labels
+// carried by `ctx`, creating it on first use. The values not carried are
+// left empty. If there are no pending labels, the `NamedQuery` itself is
+// returned.
+func (nq *NamedQuery) forContext(ctx context.Context) *NamedQuery {
+	if len(nq.pending) == 0 {
+		return nq
+	}
+	labels := queryLabels(ctx)
+
+	values := make([]string, len(nq.pending))
+	for i, label := range nq.pending {
+		values[i] = labels[label]
+	}
+	key := strings.Join(values, "\xff")
+
+	nq.mu.RLock()
+	child, ok := nq.children[key]
+	nq.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	nq.mu.Lock()
+	defer nq.mu.Unlock()
+	if child, ok := nq.children[key]; ok {
+		return child
+	}
+	all := make(prometheus.Labels, len(nq.curried)+len(nq.pending))
+	for label, value := range nq.curried {
+		all[label] = value
+	}
+	for i, label := range nq.pending {
+		all[label] = values[i]
+	}
+	child = nq.parent.newNamedQuery(nq.name, all)
+	nq.children[key] = child
+	return child
+}
+
+// withoutContext returns the `NamedQuery` of the calls without a context,
+// whose pending labels are left empty.
+func (nq *NamedQuery) withoutContext() *NamedQuery {
+	return nq.forContext(context.Background())
+}
+
+// shareMetrics makes the metrics of `nq` the ones of `child`.
+func (nq *NamedQuery) shareMetrics(child *NamedQuery) {
+	nq.TotalCalls = child.TotalCalls
+	nq.TotalDuration = child.TotalDuration
+	nq.TotalSuccess = child.TotalSuccess
+	nq.TotalFailures = child.TotalFailures
+	nq.TotalFailuresByError = child.TotalFailuresByError
+	nq.TotalRowsAffected = child.TotalRowsAffected
+	nq.TotalSlowQueries = child.TotalSlowQueries
+	nq.TotalNoRows = child.TotalNoRows
+	nq.TotalTransactions = child.TotalTransactions
+	nq.Duration = child.Duration
+	nq.RowsAffected = child.RowsAffected
 }
@@ -0,0 +1,149 @@
+package promsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultPoolBuckets are the buckets of the pool sampler histograms when
+// none are set: from 1 to 512 connections.
+var defaultPoolBuckets = prometheus.ExponentialBuckets(1, 2, 10)
+
+// poolSampler polls the pool stats at a high rate, so saturation spikes
+// shorter than the scrape interval are still reported.
+type poolSampler struct {
+	db       dbStats
+	interval time.Duration
+
+	inUse          prometheus.Histogram
+	waitCountDelta prometheus.Histogram
+
+	descInUseMax          *prometheus.Desc
+	descWaitCountDeltaMax *prometheus.Desc
+
+	mu                sync.Mutex
+	maxInUse          int
+	maxWaitCountDelta int64
+	lastWaitCount     int64
+	sampled           bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newPoolSampler(db dbStats, prefix string, opts DatabaseCollectorOpts) *poolSampler {
+	inUseBuckets := opts.InUseBuckets
+	if inUseBuckets == nil {
+		inUseBuckets = defaultPoolBuckets
+	}
+	waitCountBuckets := opts.WaitCountBuckets
+	if waitCountBuckets == nil {
+		waitCountBuckets = defaultPoolBuckets
+	}
+	return &poolSampler{
+		db:       db,
+		interval: opts.SampleInterval,
+		inUse: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%spool_in_use_sampled", prefix),
+			Help:    "The number of connections in use, sampled every sample interval.",
+			Buckets: inUseBuckets,
+		}),
+		waitCountDelta: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("db_%swait_count_delta", prefix),
+			Help:    "The number of connections waited for between two samples.",
+			Buckets: waitCountBuckets,
+		}),
+		descInUseMax:          prometheus.NewDesc(fmt.Sprintf("db_%spool_in_use_max", prefix), "The maximum number of connections in use since the last scrape.", nil, nil),
+		descWaitCountDeltaMax: prometheus.NewDesc(fmt.Sprintf("db_%swait_count_delta_max", prefix), "The maximum number of connections waited for between two samples since the last scrape.", nil, nil),
+	}
+}
+
+// sample reads the pool stats once.
+func (s *poolSampler) sample() {
+	stats := s.db.Stats()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inUse.Observe(float64(stats.InUse))
+	if stats.InUse > s.maxInUse {
+		s.maxInUse = stats.InUse
+	}
+	if s.sampled {
+		delta := stats.WaitCount - s.lastWaitCount
+		s.waitCountDelta.Observe(float64(delta))
+		if delta > s.maxWaitCountDelta {
+			s.maxWaitCountDelta = delta
+		}
+	}
+	s.lastWaitCount = stats.WaitCount
+	s.sampled = true
+}
+
+func (s *poolSampler) describe(ch chan<- *prometheus.Desc) {
+	s.inUse.Describe(ch)
+	s.waitCountDelta.Describe(ch)
+	ch <- s.descInUseMax
+	ch <- s.descWaitCountDeltaMax
+}
+
+// collect reports the histograms and the maximums, resetting the latter.
+// The stats read by the scrape itself are also taken into account, so the
+// maximum in use is never lower than the current value. The histograms are
+// collected along with the maximums, so both report the same samples.
+func (s *poolSampler) collect(ch chan<- prometheus.Metric, stats sql.DBStats) {
+	s.mu.Lock()
+	maxInUse, maxWaitCountDelta := s.maxInUse, s.maxWaitCountDelta
+	s.maxInUse, s.maxWaitCountDelta = 0, 0
+	s.inUse.Collect(ch)
+	s.waitCountDelta.Collect(ch)
+	s.mu.Unlock()
+
+	if stats.InUse > maxInUse {
+		maxInUse = stats.InUse
+	}
+	ch <- prometheus.MustNewConstMetric(s.descInUseMax, prometheus.GaugeValue, float64(maxInUse))
+	ch <- prometheus.MustNewConstMetric(s.descWaitCountDeltaMax, prometheus.GaugeValue, float64(maxWaitCountDelta))
+}
+
+func (s *poolSampler) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.cancel, s.done = cancel, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.sample()
+			}
+		}
+	}()
+}
+
+func (s *poolSampler) stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,71 @@
+// Package prompq provides github.com/lib/pq specific helpers for the promsql
+// collectors.
+package prompq
+
+import (
+	"github.com/lib/pq"
+)
+
+// ClassifyError is a promsql.ErrorClassifier that maps `*pq.Error` SQLSTATE
+// codes to error classes. Errors not returned by the Postgres server are not
+// classified, so the built-in classes are used for them.
+//
+// Example:
+//
+// ```
+// collector, err := promsql.Register(promsql.DriverCollectorOpts{DriverName: "postgres", ErrorClassifier: prompq.ClassifyError})
+// ```
+func ClassifyError(err error) string {
+	var pqErr *pq.Error
+	switch e := err.(type) {
+	case *pq.Error:
+		pqErr = e
+	case pq.Error:
+		pqErr = &e
+	default:
+		return ""
+	}
+
+	// Some codes are worth their own classes, as they are usually handled
+	// differently by the application (e.g. retrying the transaction).
+	switch pqErr.Code {
+	case "40001":
+		return "serialization_failure"
+	case "40P01":
+		return "deadlock_detected"
+	case "57014":
+		return "query_canceled"
+	}
+
+	switch pqErr.Code.Class() {
+	case "08":
+		return "connection_exception"
+	case "22":
+		return "data_exception"
+	case "23":
+		return "integrity_violation"
+	case "25":
+		return "invalid_transaction_state"
+	case "28":
+		return "invalid_authorization"
+	case "40":
+		return "transaction_rollback"
+	case "42":
+		return "syntax_error_or_access_rule_violation"
+	case "53":
+		return "insufficient_resources"
+	case "54":
+		return "program_limit_exceeded"
+	case "57":
+		return "operator_intervention"
+	case "58":
+		return "system_error"
+	case "XX":
+		return "internal_error"
+	}
+
+	if name := pqErr.Code.Class().Name(); name != "" {
+		return name
+	}
+	return "postgres_error"
+}
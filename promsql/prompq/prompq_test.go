@@ -0,0 +1,34 @@
+package prompq_test
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lab259/go-rscsrv-prometheus/ginkgotest"
+	"github.com/lab259/go-rscsrv-prometheus/promsql/prompq"
+	"github.com/lib/pq"
+)
+
+func TestPrompq(t *testing.T) {
+	ginkgotest.Init("prompq Test Suite", t)
+}
+
+var _ = Describe("ClassifyError", func() {
+	It("should classify by SQLSTATE class", func() {
+		Expect(prompq.ClassifyError(&pq.Error{Code: "23505"})).To(Equal("integrity_violation"))
+		Expect(prompq.ClassifyError(&pq.Error{Code: "42601"})).To(Equal("syntax_error_or_access_rule_violation"))
+		Expect(prompq.ClassifyError(pq.Error{Code: "08006"})).To(Equal("connection_exception"))
+	})
+
+	It("should use specific classes for retriable errors", func() {
+		Expect(prompq.ClassifyError(&pq.Error{Code: "40001"})).To(Equal("serialization_failure"))
+		Expect(prompq.ClassifyError(&pq.Error{Code: "40P01"})).To(Equal("deadlock_detected"))
+	})
+
+	It("should not classify other errors", func() {
+		Expect(prompq.ClassifyError(errors.New("some error"))).To(BeEmpty())
+	})
+})
@@ -0,0 +1,328 @@
+package promsql
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// queryNameMarker matches the lines starting a new statement in a `.sql`
+// file: `-- name: fetch_users`.
+var queryNameMarker = regexp.MustCompile(`^--\s*name\s*:(.*)$`)
+
+var validQueryName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\-.]*$`)
+
+// QueryDefinition is a named statement parsed from a `.sql` file.
+type QueryDefinition struct {
+	Name string
+	SQL  string
+	// File and Line locate the `-- name:` marker of the statement.
+	File string
+	Line int
+}
+
+// ParseQueries parses the statements of a `.sql` file. Each statement is
+// preceded by a `-- name: <name>` marker:
+//
+// ```
+// -- name: fetch_users
+// SELECT id, name FROM users WHERE active = $1;
+//
+// -- name: delete_user
+// DELETE FROM users WHERE id = $1;
+// ```
+//
+// `file` is only used by the error messages. An error is returned if there is
+// a statement before the first marker, if a marker has an invalid name, if a
+// statement is empty or if a name is used more than once.
+func ParseQueries(file string, r io.Reader) ([]QueryDefinition, error) {
+	var (
+		definitions []QueryDefinition
+		current     *QueryDefinition
+		body        []string
+		lineNumber  int
+	)
+
+	flush := func() error {
+		if current == nil {
+			// Only comments and blank lines are accepted before the first
+			// marker. The lines are joined before being tokenized, as a
+			// comment may span several of them.
+			for i := range body {
+				if len(tokenize(strings.Join(body[:i+1], "\n"))) > 0 {
+					return fmt.Errorf("promsql: %s:%d: statement without a `-- name:` marker", file, i+1)
+				}
+			}
+			return nil
+		}
+		current.SQL = strings.TrimSpace(strings.Join(body, "\n"))
+		if len(tokenize(current.SQL)) == 0 {
+			return fmt.Errorf("promsql: %s:%d: query %q is empty", file, current.Line, current.Name)
+		}
+		definitions = append(definitions, *current)
+		return nil
+	}
+
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		match := queryNameMarker.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			body = append(body, line)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		name := strings.TrimSpace(match[1])
+		if !validQueryName.MatchString(name) {
+			return nil, fmt.Errorf("promsql: %s:%d: invalid query name %q", file, lineNumber, name)
+		}
+		if previous, ok := seen[name]; ok {
+			return nil, fmt.Errorf("promsql: %s:%d: query %q already defined at line %d", file, lineNumber, name, previous)
+		}
+		seen[name] = lineNumber
+		current = &QueryDefinition{Name: name, File: file, Line: lineNumber}
+		body = body[:0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("promsql: %s: %v", file, err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+// Queries is a registry of named statements, usually loaded from `.sql`
+// files, whose executions are recorded by a `QueryCollector`.
+//
+// Example:
+//
+// ```
+// queries := promsql.NewQueries(collector)
+// err := queries.LoadDir("sql")
+// // ...
+// rs, err := queries.Get("fetch_users")(db).QueryContext(ctx, true)
+// ```
+type Queries struct {
+	collector *QueryCollector
+
+	mu      sync.RWMutex
+	queries map[string]*storedQuery
+}
+
+type storedQuery struct {
+	QueryDefinition
+	handler QueryHandler
+}
+
+// NewQueries returns a new empty instance of *Queries recording its
+// statements into `collector`.
+func NewQueries(collector *QueryCollector) *Queries {
+	return &Queries{
+		collector: collector,
+		queries:   make(map[string]*storedQuery),
+	}
+}
+
+// Add registers the given statements, each one backed by
+// `QueryCollector.NamedQuery`. Nothing is registered if any of the names is
+// already taken or given more than once.
+func (q *Queries) Add(definitions ...QueryDefinition) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := make(map[string]QueryDefinition, len(definitions))
+	for _, definition := range definitions {
+		previous, ok := batch[definition.Name]
+		if stored, found := q.queries[definition.Name]; found {
+			previous, ok = stored.QueryDefinition, true
+		}
+		if ok {
+			return fmt.Errorf("promsql: %s:%d: query %q already defined at %s:%d", definition.File, definition.Line, definition.Name, previous.File, previous.Line)
+		}
+		batch[definition.Name] = definition
+	}
+	for _, definition := range definitions {
+		q.queries[definition.Name] = &storedQuery{
+			QueryDefinition: definition,
+			handler:         q.collector.NamedQuery(definition.Name),
+		}
+	}
+	return nil
+}
+
+// Load parses the statements read from `r` (see `ParseQueries`) and
+// registers them.
+func (q *Queries) Load(file string, r io.Reader) error {
+	definitions, err := ParseQueries(file, r)
+	if err != nil {
+		return err
+	}
+	return q.Add(definitions...)
+}
+
+// LoadFile loads the statements of the `.sql` file at `name`.
+func (q *Queries) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return q.Load(name, f)
+}
+
+// LoadDir loads all the `.sql` files of the directory `dir`.
+func (q *Queries) LoadDir(dir string) error {
+	return q.LoadFileSystem(http.Dir(dir), "/")
+}
+
+// LoadFileSystem loads all the `.sql` files of the directory `dir` of `fs`,
+// in lexical order. Subdirectories are not visited. All the files are parsed
+// before their statements are registered, so nothing is registered if any of
+// them fails.
+//
+// Any `http.FileSystem` can be used, such as the ones generated by tools
+// that embed files into the binary.
+func (q *Queries) LoadFileSystem(fs http.FileSystem, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && path.Ext(info.Name()) == ".sql" {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var definitions []QueryDefinition
+	for _, name := range names {
+		parsed, err := parseQueriesFromFileSystem(fs, path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		definitions = append(definitions, parsed...)
+	}
+	return q.Add(definitions...)
+}
+
+func parseQueriesFromFileSystem(fs http.FileSystem, name string) ([]QueryDefinition, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseQueries(name, f)
+}
+
+// Names returns the names of the statements registered, sorted.
+func (q *Queries) Names() []string {
+	q.mu.RLock()
+	names := make([]string, 0, len(q.queries))
+	for name := range q.queries {
+		names = append(names, name)
+	}
+	q.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the handler of the statement `name`, if registered.
+func (q *Queries) Lookup(name string) (StoredQueryHandler, bool) {
+	q.mu.RLock()
+	stored, ok := q.queries[name]
+	q.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return func(db DBQueryProxy) *StoredQuery {
+		return &StoredQuery{query: stored.handler(db), sql: stored.SQL}
+	}, true
+}
+
+// Get returns the handler of the statement `name`. It panics if there is no
+// such statement, as it means the `.sql` files and the code are out of sync.
+func (q *Queries) Get(name string) StoredQueryHandler {
+	handler, ok := q.Lookup(name)
+	if !ok {
+		panic(fmt.Sprintf("promsql: query %q not found", name))
+	}
+	return handler
+}
+
+// StoredQueryHandler is returned by `Queries.Get` to bind a stored statement
+// to a `sql.DB` (or `sql.Tx`).
+type StoredQueryHandler func(DBQueryProxy) *StoredQuery
+
+// StoredQuery runs a stored statement through a `Query`, so its metrics are
+// recorded under the name of the statement.
+type StoredQuery struct {
+	query *Query
+	sql   string
+}
+
+// SQL returns the statement.
+func (s *StoredQuery) SQL() string {
+	return s.sql
+}
+
+// Query runs the statement. See `Query.Query`.
+func (s *StoredQuery) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.query.Query(s.sql, args...)
+}
+
+// QueryContext runs the statement. See `Query.QueryContext`.
+func (s *StoredQuery) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	return s.query.QueryContext(ctx, s.sql, args...)
+}
+
+// QueryRow runs the statement. See `Query.QueryRow`.
+func (s *StoredQuery) QueryRow(args ...interface{}) *Row {
+	return s.query.QueryRow(s.sql, args...)
+}
+
+// QueryRowContext runs the statement. See `Query.QueryRowContext`.
+func (s *StoredQuery) QueryRowContext(ctx context.Context, args ...interface{}) *Row {
+	return s.query.QueryRowContext(ctx, s.sql, args...)
+}
+
+// Exec runs the statement. See `Query.Exec`.
+func (s *StoredQuery) Exec(args ...interface{}) (sql.Result, error) {
+	return s.query.Exec(s.sql, args...)
+}
+
+// ExecContext runs the statement. See `Query.ExecContext`.
+func (s *StoredQuery) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	return s.query.ExecContext(ctx, s.sql, args...)
+}
+
+// Prepare prepares the statement. See `Query.Prepare`.
+func (s *StoredQuery) Prepare() (*Stmt, error) {
+	return s.query.Prepare(s.sql)
+}
+
+// PrepareContext prepares the statement. See `Query.PrepareContext`.
+func (s *StoredQuery) PrepareContext(ctx context.Context) (*Stmt, error) {
+	return s.query.PrepareContext(ctx, s.sql)
+}
@@ -0,0 +1,117 @@
+package promsql_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+var _ = Describe("Queries", func() {
+	When("parsing", func() {
+		It("should split the statements by name", func() {
+			definitions, err := promsql.ParseQueries("users.sql", strings.NewReader(`-- users queries
+
+-- name: fetch_users
+SELECT id
+FROM users;
+--name:delete_user
+DELETE FROM users WHERE id = $1;
+`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(definitions).To(Equal([]promsql.QueryDefinition{
+				{Name: "fetch_users", SQL: "SELECT id\nFROM users;", File: "users.sql", Line: 3},
+				{Name: "delete_user", SQL: "DELETE FROM users WHERE id = $1;", File: "users.sql", Line: 6},
+			}))
+		})
+
+		It("should fail on duplicate names", func() {
+			_, err := promsql.ParseQueries("users.sql", strings.NewReader("-- name: a\nSELECT 1;\n-- name: a\nSELECT 2;\n"))
+			Expect(err).To(MatchError(`promsql: users.sql:3: query "a" already defined at line 1`))
+		})
+
+		It("should fail on statements without a name", func() {
+			_, err := promsql.ParseQueries("users.sql", strings.NewReader("-- users queries\n/* multi\nline */\nSELECT 1;\n-- name: a\nSELECT 2;\n"))
+			Expect(err).To(MatchError("promsql: users.sql:4: statement without a `-- name:` marker"))
+		})
+
+		It("should fail on empty statements", func() {
+			_, err := promsql.ParseQueries("users.sql", strings.NewReader("-- name: a\n-- nothing here\n-- name: b\nSELECT 2;\n"))
+			Expect(err).To(MatchError(`promsql: users.sql:1: query "a" is empty`))
+		})
+
+		It("should fail on invalid names", func() {
+			_, err := promsql.ParseQueries("users.sql", strings.NewReader("-- name: fetch users\nSELECT 1;\n"))
+			Expect(err).To(MatchError(`promsql: users.sql:1: invalid query name "fetch users"`))
+		})
+	})
+
+	It("should load the .sql files of a directory", func() {
+		queries := promsql.NewQueries(promsql.NewQueryCollector(&promsql.QueryCollectorOpts{}))
+		Expect(queries.LoadFileSystem(http.Dir("testdata"), "/queries")).To(Succeed())
+		Expect(queries.Names()).To(Equal([]string{"fetch_roles", "fetch_users", "update_user_name"}))
+		Expect(queries.Get("fetch_users")(nil).SQL()).To(Equal("SELECT id, name\nFROM users\nWHERE active = $1;"))
+	})
+
+	It("should fail on names already loaded", func() {
+		queries := promsql.NewQueries(promsql.NewQueryCollector(&promsql.QueryCollectorOpts{}))
+		Expect(queries.LoadDir("testdata/queries")).To(Succeed())
+		err := queries.Load("more.sql", strings.NewReader("-- name: fetch_others\nSELECT 1;\n-- name: fetch_roles\nSELECT 2;\n"))
+		Expect(err).To(MatchError(`promsql: more.sql:3: query "fetch_roles" already defined at /roles.sql:1`))
+
+		_, ok := queries.Lookup("fetch_others")
+		Expect(ok).To(BeFalse())
+		Expect(func() { queries.Get("fetch_others") }).To(Panic())
+	})
+
+	It("should not load any statement of a directory if a file fails", func() {
+		queries := promsql.NewQueries(promsql.NewQueryCollector(&promsql.QueryCollectorOpts{}))
+		err := queries.LoadDir("testdata/conflicting_queries")
+		Expect(err).To(MatchError(`promsql: /b.sql:1: query "fetch_users" already defined at /a.sql:4`))
+		Expect(queries.Names()).To(BeEmpty())
+	})
+
+	It("should fail on names given twice to Add", func() {
+		queries := promsql.NewQueries(promsql.NewQueryCollector(&promsql.QueryCollectorOpts{}))
+		err := queries.Add(
+			promsql.QueryDefinition{Name: "a", SQL: "SELECT 1;", File: "a.sql", Line: 1},
+			promsql.QueryDefinition{Name: "a", SQL: "SELECT 2;", File: "b.sql", Line: 2},
+		)
+		Expect(err).To(MatchError(`promsql: b.sql:2: query "a" already defined at a.sql:1`))
+		Expect(queries.Names()).To(BeEmpty())
+	})
+
+	It("should run the stored statements recording their metrics", func() {
+		var reported []promsql.SlowQuery
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			SlowQuery: promsql.SlowQueryOpts{
+				Threshold: time.Nanosecond,
+				Callback: func(q promsql.SlowQuery) {
+					reported = append(reported, q)
+				},
+			},
+		})
+		queries := promsql.NewQueries(collector)
+		Expect(queries.LoadFile("testdata/queries/users.sql")).To(Succeed())
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := queries.Get("update_user_name")(db).ExecContext(context.Background(), "john", 1)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(reported).To(HaveLen(1))
+		Expect(reported[0].Name).To(Equal("update_user_name"))
+		Expect(reported[0].Query).To(Equal("UPDATE users SET name = $1 WHERE id = $2;"))
+		Expect(reported[0].Args).To(HaveLen(2))
+
+		var metric dto.Metric
+		Expect(collector.NewNamedQuery("update_user_name").TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+})
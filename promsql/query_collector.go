@@ -11,11 +11,22 @@ import (
 // available metrics. Those metrics are reused by `NamedQuery` with the query
 // name as a label value.
 type QueryCollector struct {
-	totalCalls        *prometheus.CounterVec
-	totalDuration     *prometheus.CounterVec
-	totalSuccesses    *prometheus.CounterVec
-	totalFailures     *prometheus.CounterVec
-	totalRowsAffected *prometheus.CounterVec
+	totalCalls           *prometheus.CounterVec
+	totalDuration        *prometheus.CounterVec
+	totalSuccesses       *prometheus.CounterVec
+	totalFailures        *prometheus.CounterVec
+	totalFailuresByError *prometheus.CounterVec
+	totalRowsAffected    *prometheus.CounterVec
+	totalSlowQueries     *prometheus.CounterVec
+	totalNoRows          *prometheus.CounterVec
+	totalTransactions    *prometheus.CounterVec
+	duration             *prometheus.HistogramVec
+	rowsAffected         *prometheus.HistogramVec
+
+	labels          []string
+	errorClassifier ErrorClassifier
+	slowQueries     *slowQueryLog
+	statements      *StatementTracker
 }
 
 // QueryHandler is returned by the `QueryCollector.NamedQuery` helper method for
@@ -26,10 +37,47 @@ type QueryHandler func(DBQueryProxy) *Query
 type QueryCollectorOpts struct {
 	// Prefix: responsible for all counters descs prefix
 	Prefix string
+	// ErrorClassifier: classifies the errors reported by the `error` label of
+	// the failures by error counter. The DefaultErrorClassifier is used when
+	// it is nil or cannot classify an error.
+	ErrorClassifier ErrorClassifier
+	// SlowQuery: reports the queries slower than its threshold. Disabled by
+	// default.
+	SlowQuery SlowQueryOpts
+	// Statements: records the statements of the queries in a
+	// StatementTracker. Leave it nil if the tracker is already fed by the
+	// `DriverCollector` of the same database, or the statements are counted
+	// twice.
+	Statements *StatementTracker
+	// Buckets: defines the buckets of the duration histogram. If nil,
+	// prometheus.DefBuckets is used.
+	Buckets []float64
+	// RowsAffectedBuckets: defines the buckets of the rows affected
+	// histogram. If nil, exponential buckets from 1 to 65536 rows are used.
+	RowsAffectedBuckets []float64
+	// Labels: declares extra labels (e.g. `tenant` or `shard`) added to all
+	// metrics, after `name`. Their values are given to `NewNamedQuery` or,
+	// at call time, by the context (see `WithQueryLabels`).
+	Labels []string
 }
 
 var queryCollectorLabels = []string{"name"}
 
+var queryCollectorErrorLabels = []string{"error"}
+
+var queryCollectorDurationLabels = []string{"outcome"}
+
+var queryCollectorTransactionLabels = []string{"operation", "outcome"}
+
+// queryCollectorLabelNames returns the labels of a metric: the `name`, the
+// extra labels and then the labels specific to the metric.
+func queryCollectorLabelNames(extra []string, labels ...string) []string {
+	names := make([]string, 0, len(queryCollectorLabels)+len(extra)+len(labels))
+	names = append(names, queryCollectorLabels...)
+	names = append(names, extra...)
+	return append(names, labels...)
+}
+
 // NewQueryCollector returns a new QueryCollector pointer
 func NewQueryCollector(opts *QueryCollectorOpts) *QueryCollector {
 	prefix := opts.Prefix
@@ -37,6 +85,23 @@ func NewQueryCollector(opts *QueryCollectorOpts) *QueryCollector {
 		prefix += "_"
 	}
 
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+
+	rowsAffectedBuckets := opts.RowsAffectedBuckets
+	if rowsAffectedBuckets == nil {
+		rowsAffectedBuckets = defaultRowsBuckets
+	}
+
+	var (
+		labels             = queryCollectorLabelNames(opts.Labels)
+		errorLabels        = queryCollectorLabelNames(opts.Labels, queryCollectorErrorLabels...)
+		durationLabels     = queryCollectorLabelNames(opts.Labels, queryCollectorDurationLabels...)
+		transactionsLabels = queryCollectorLabelNames(opts.Labels, queryCollectorTransactionLabels...)
+	)
+
 	// TODO: Add prefix name and descriptions
 	return &QueryCollector{
 		totalCalls: prometheus.NewCounterVec(
@@ -44,51 +109,156 @@ func NewQueryCollector(opts *QueryCollectorOpts) *QueryCollector {
 				Name: fmt.Sprintf("namedqry_%stotal_calls", prefix),
 				Help: "The total number of calls from a query",
 			},
-			queryCollectorLabels,
+			labels,
 		),
 		totalDuration: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: fmt.Sprintf("namedqry_%stotal_duration_seconds", prefix),
 				Help: "The total duration (in seconds) from a query processed",
 			},
-			queryCollectorLabels,
+			labels,
 		),
 		totalSuccesses: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: fmt.Sprintf("namedqry_%stotal_successes", prefix),
 				Help: "The total number of a query processed with success",
 			},
-			queryCollectorLabels,
+			labels,
 		),
 		totalFailures: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: fmt.Sprintf("namedqry_%stotal_failures", prefix),
 				Help: "The total number of a query processed with failure",
 			},
-			queryCollectorLabels,
+			labels,
+		),
+		totalFailuresByError: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("namedqry_%stotal_failures_by_error", prefix),
+				Help: "The total number of a query processed with failure, partitioned by error class",
+			},
+			errorLabels,
 		),
 		totalRowsAffected: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: fmt.Sprintf("namedqry_%stotal_rows_affected", prefix),
 				Help: "The total number of rows affected by a query",
 			},
-			queryCollectorLabels,
+			labels,
+		),
+		totalSlowQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("namedqry_%sslow_queries_total", prefix),
+				Help: "The total number of a query processed slower than the slow query threshold",
+			},
+			labels,
+		),
+		totalNoRows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("namedqry_%stotal_no_rows", prefix),
+				Help: "The total number of a query row scanned without results",
+			},
+			labels,
+		),
+		totalTransactions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("namedqry_%stotal_transactions", prefix),
+				Help: "The total number of commits and rollbacks of the transactions begun by a query",
+			},
+			transactionsLabels,
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    fmt.Sprintf("namedqry_%sduration_seconds", prefix),
+				Help:    "The duration (in seconds) from a query processed, partitioned by outcome",
+				Buckets: buckets,
+			},
+			durationLabels,
+		),
+		rowsAffected: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    fmt.Sprintf("namedqry_%srows_affected", prefix),
+				Help:    "The number of rows affected by each execution of a query",
+				Buckets: rowsAffectedBuckets,
+			},
+			labels,
 		),
+		labels:          opts.Labels,
+		errorClassifier: opts.ErrorClassifier,
+		slowQueries:     newSlowQueryLog(opts.SlowQuery),
+		statements:      opts.Statements,
 	}
 }
 
 // NewNamedQuery returns a new instance of `NamedQuery` with its metrics
 // initialized with the query name as a label.
-func (collector *QueryCollector) NewNamedQuery(name string) *NamedQuery {
+//
+// When the collector declares extra labels, their values can be given by
+// `labels`. The ones left out are read, at call time, from the context (see
+// `WithQueryLabels`) or left empty when the call has no context. Then, the
+// metrics of each combination of values are only created once a call
+// carries it, and the metric fields of the returned `NamedQuery` are the
+// ones of the calls without a context. It panics if `labels` has a label not
+// declared by the collector.
+func (collector *QueryCollector) NewNamedQuery(name string, labels ...prometheus.Labels) *NamedQuery {
+	curried := prometheus.Labels{"name": name}
+	for _, l := range labels {
+		for label, value := range l {
+			if !collector.hasLabel(label) {
+				panic(fmt.Sprintf("promsql: label %q not declared by the QueryCollectorOpts", label))
+			}
+			curried[label] = value
+		}
+	}
+
+	var pending []string
+	for _, label := range collector.labels {
+		if _, ok := curried[label]; !ok {
+			pending = append(pending, label)
+		}
+	}
+
+	if len(pending) > 0 {
+		nq := &NamedQuery{
+			parent:   collector,
+			name:     name,
+			curried:  curried,
+			pending:  pending,
+			children: make(map[string]*NamedQuery),
+		}
+		nq.shareMetrics(nq.withoutContext())
+		return nq
+	}
+	return collector.newNamedQuery(name, curried)
+}
+
+// newNamedQuery initializes the metrics of a `NamedQuery` with the given
+// labels.
+func (collector *QueryCollector) newNamedQuery(name string, labels prometheus.Labels) *NamedQuery {
 	return &NamedQuery{
-		parent:            collector,
-		name:              name,
-		TotalCalls:        collector.totalCalls.WithLabelValues(name),
-		TotalDuration:     collector.totalDuration.WithLabelValues(name),
-		TotalSuccess:      collector.totalSuccesses.WithLabelValues(name),
-		TotalFailures:     collector.totalFailures.WithLabelValues(name),
-		TotalRowsAffected: collector.totalRowsAffected.WithLabelValues(name),
+		parent:               collector,
+		name:                 name,
+		TotalCalls:           collector.totalCalls.With(labels),
+		TotalDuration:        collector.totalDuration.With(labels),
+		TotalSuccess:         collector.totalSuccesses.With(labels),
+		TotalFailures:        collector.totalFailures.With(labels),
+		TotalFailuresByError: collector.totalFailuresByError.MustCurryWith(labels),
+		TotalRowsAffected:    collector.totalRowsAffected.With(labels),
+		TotalSlowQueries:     collector.totalSlowQueries.With(labels),
+		TotalNoRows:          collector.totalNoRows.With(labels),
+		TotalTransactions:    collector.totalTransactions.MustCurryWith(labels),
+		Duration:             collector.duration.MustCurryWith(labels),
+		RowsAffected:         collector.rowsAffected.With(labels),
+	}
+}
+
+func (collector *QueryCollector) hasLabel(label string) bool {
+	for _, l := range collector.labels {
+		if l == label {
+			return true
+		}
 	}
+	return false
 }
 
 // NamedQuery creates internally a `NamedQuery` and then returns a 2nd order
@@ -104,8 +274,8 @@ func (collector *QueryCollector) NewNamedQuery(name string) *NamedQuery {
 //
 // In the example above, a new `Query` is created everytime `nqFUH` is
 // called. Also, a `sql.TX` can be used instead of using a `sql.DB` reference.
-func (collector *QueryCollector) NamedQuery(name string) QueryHandler {
-	nqry := collector.NewNamedQuery(name)
+func (collector *QueryCollector) NamedQuery(name string, labels ...prometheus.Labels) QueryHandler {
+	nqry := collector.NewNamedQuery(name, labels...)
 	return func(db DBQueryProxy) *Query {
 		return NewQuery(nqry, db)
 	}
@@ -117,7 +287,13 @@ func (collector *QueryCollector) Describe(ch chan<- *prometheus.Desc) {
 	collector.totalDuration.Describe(ch)
 	collector.totalSuccesses.Describe(ch)
 	collector.totalFailures.Describe(ch)
+	collector.totalFailuresByError.Describe(ch)
 	collector.totalRowsAffected.Describe(ch)
+	collector.totalSlowQueries.Describe(ch)
+	collector.totalNoRows.Describe(ch)
+	collector.totalTransactions.Describe(ch)
+	collector.duration.Describe(ch)
+	collector.rowsAffected.Describe(ch)
 }
 
 // Collect forwards all collect calls to all metrics.
@@ -126,5 +302,11 @@ func (collector *QueryCollector) Collect(metrics chan<- prometheus.Metric) {
 	collector.totalDuration.Collect(metrics)
 	collector.totalSuccesses.Collect(metrics)
 	collector.totalFailures.Collect(metrics)
+	collector.totalFailuresByError.Collect(metrics)
 	collector.totalRowsAffected.Collect(metrics)
+	collector.totalSlowQueries.Collect(metrics)
+	collector.totalNoRows.Collect(metrics)
+	collector.totalTransactions.Collect(metrics)
+	collector.duration.Collect(metrics)
+	collector.rowsAffected.Collect(metrics)
 }
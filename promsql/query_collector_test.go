@@ -0,0 +1,377 @@
+package promsql_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/lab259/go-rscsrv-prometheus/ginkgotest"
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+func TestPromsqlQueryCollector(t *testing.T) {
+	ginkgotest.Init("Promsql QueryCollector Test Suite", t)
+}
+
+var _ = Describe("Query Collector", func() {
+	It("should count failures by error class", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Exec("fail")
+		Expect(err).To(MatchError(errFakeQuery))
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalFailures.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalFailuresByError.WithLabelValues(promsql.ErrorClassOther).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should use the configured error classifier", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			ErrorClassifier: func(err error) string {
+				return "custom"
+			},
+		})
+		namedQuery := collector.NewNamedQuery("users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Query("fail")
+		Expect(err).To(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalFailuresByError.WithLabelValues("custom").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+	It("should report slow queries", func() {
+		var reported []promsql.SlowQuery
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			SlowQuery: promsql.SlowQueryOpts{
+				Threshold: time.Nanosecond,
+				Callback: func(q promsql.SlowQuery) {
+					reported = append(reported, q)
+				},
+			},
+		})
+		namedQuery := collector.NewNamedQuery("update_users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Exec("update users set name = $1", "john")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(reported).To(HaveLen(1))
+		Expect(reported[0].Name).To(Equal("update_users"))
+		Expect(reported[0].Query).To(Equal("update users set name = $1"))
+		Expect(reported[0].Args).To(Equal([]string{"?"}))
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalSlowQueries.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+	It("should observe durations and rows affected", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			Buckets:             []float64{0.1, 1},
+			RowsAffectedBuckets: []float64{1, 10},
+		})
+		namedQuery := collector.NewNamedQuery("update_users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		query := promsql.NewQuery(namedQuery, db)
+		_, err := query.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = query.Exec("update fail")
+		Expect(err).To(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(namedQuery.Duration.WithLabelValues("success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(metric.GetHistogram().GetBucket()).To(HaveLen(2))
+		Expect(namedQuery.Duration.WithLabelValues("failure").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(namedQuery.RowsAffected.(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(metric.GetHistogram().GetSampleSum()).To(BeEquivalentTo(1))
+	})
+	It("should observe the executions whose rows affected are unknown as failures", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("create_users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Exec("create table users (id int)")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalFailures.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.Duration.WithLabelValues("failure").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(namedQuery.Duration.WithLabelValues("success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeZero())
+	})
+
+	It("should record the metrics of rows when scanned", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("fetch_user")
+
+		db := openFakeDB(&fakeDriver{rows: 1})
+		defer db.Close()
+		var id int64
+		Expect(promsql.NewQuery(namedQuery, db).QueryRow("select id from users").Scan(&id)).To(Succeed())
+
+		emptyDB := openFakeDB(&fakeDriver{})
+		defer emptyDB.Close()
+		Expect(promsql.NewQuery(namedQuery, emptyDB).QueryRowContext(context.Background(), "select id from users").Scan(&id)).To(Equal(sql.ErrNoRows))
+		Expect(promsql.NewQuery(namedQuery, emptyDB).QueryRow("select fail").Scan(&id)).To(MatchError(errFakeQuery))
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalCalls.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(3))
+		Expect(namedQuery.TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalNoRows.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalFailures.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.Duration.WithLabelValues("no_rows").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should record the outcome of a row once, regardless of its conversion errors", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("fetch_user")
+
+		db := openFakeDB(&fakeDriver{rows: 1})
+		defer db.Close()
+		row := promsql.NewQuery(namedQuery, db).QueryRow("select id from users")
+		var id struct{}
+		Expect(row.Scan(&id)).ShouldNot(Succeed())
+		Expect(row.Scan(&id)).ShouldNot(Succeed())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalCalls.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalFailures.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeZero())
+		Expect(namedQuery.Duration.WithLabelValues("success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+	})
+
+	It("should keep the query name of prepared statements", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("update_users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		stmt, err := promsql.NewQuery(namedQuery, db).Prepare("update users set name = $1")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer stmt.Close()
+		_, err = stmt.Exec("john")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = stmt.ExecContext(context.Background(), "jane")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+		Expect(namedQuery.TotalRowsAffected.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+	})
+
+	It("should accept a Query as proxy", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		inner := collector.NewNamedQuery("inner")
+		outer := collector.NewNamedQuery("outer")
+		db := openFakeDB(&fakeDriver{rows: 1})
+		defer db.Close()
+
+		var proxy promsql.DBQueryProxy = promsql.NewQuery(inner, db)
+		query := promsql.NewQuery(outer, proxy)
+		_, err := query.Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var id int64
+		Expect(query.QueryRow("select id from users").Scan(&id)).To(Equal(promsql.ErrQueryRowNotSupported))
+		_, err = query.Prepare("select id from users")
+		Expect(err).To(Equal(promsql.ErrPrepareNotSupported))
+
+		var metric dto.Metric
+		Expect(inner.TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(outer.TotalCalls.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+		Expect(outer.TotalFailures.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should count commits and rollbacks of transactions", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		namedQuery := collector.NewNamedQuery("transfer")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		query := promsql.NewQuery(namedQuery, db)
+		tx, err := query.BeginTx(context.Background(), nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = promsql.NewQuery(namedQuery, tx).Exec("update accounts set balance = 0")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Commit()).To(Succeed())
+		Expect(tx.Rollback()).To(Equal(sql.ErrTxDone))
+
+		tx, err = query.BeginTx(context.Background(), nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = promsql.NewQuery(namedQuery, tx).BeginTx(context.Background(), nil)
+		Expect(err).To(Equal(promsql.ErrBeginTxNotSupported))
+		Expect(tx.Rollback()).To(Succeed())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalTransactions.WithLabelValues("commit", "success").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalTransactions.WithLabelValues("rollback", "success").Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should add the extra labels given to the named query", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			Labels: []string{"tenant"},
+		})
+		namedQuery := collector.NewNamedQuery("users", prometheus.Labels{"tenant": "acme"})
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(queryCounterValue(collector, "namedqry_total_successes", prometheus.Labels{"name": "users", "tenant": "acme"})).To(BeEquivalentTo(1))
+	})
+
+	It("should read the pending extra labels from the context", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			Labels: []string{"tenant", "shard"},
+		})
+		handler := collector.NamedQuery("users", prometheus.Labels{"shard": "1"})
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		ctx := promsql.WithQueryLabels(context.Background(), prometheus.Labels{"tenant": "acme"})
+		_, err := handler(db).ExecContext(ctx, "update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = handler(db).ExecContext(ctx, "update fail")
+		Expect(err).To(HaveOccurred())
+		_, err = handler(db).Exec("update users set name = 'jane'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(queryCounterValue(collector, "namedqry_total_calls", prometheus.Labels{"name": "users", "tenant": "acme", "shard": "1"})).To(BeEquivalentTo(2))
+		Expect(queryCounterValue(collector, "namedqry_total_failures_by_error", prometheus.Labels{"name": "users", "tenant": "acme", "shard": "1", "error": promsql.ErrorClassOther})).To(BeEquivalentTo(1))
+		Expect(queryCounterValue(collector, "namedqry_total_calls", prometheus.Labels{"name": "users", "tenant": "", "shard": "1"})).To(BeEquivalentTo(1))
+	})
+
+	It("should only export the pending extra labels once they are known", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			Labels: []string{"tenant"},
+		})
+		namedQuery := collector.NewNamedQuery("users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		tenants := func() []string {
+			registry := prometheus.NewRegistry()
+			Expect(registry.Register(collector)).To(Succeed())
+			families, err := registry.Gather()
+			Expect(err).ShouldNot(HaveOccurred())
+			seen := make(map[string]bool)
+			var tenants []string
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					for _, pair := range metric.GetLabel() {
+						if pair.GetName() == "tenant" && !seen[pair.GetValue()] {
+							seen[pair.GetValue()] = true
+							tenants = append(tenants, pair.GetValue())
+						}
+					}
+				}
+			}
+			return tenants
+		}
+		// The metrics of the calls without a context back the named query.
+		Expect(tenants()).To(ConsistOf(""))
+
+		ctx := promsql.WithQueryLabels(context.Background(), prometheus.Labels{"tenant": "acme"})
+		_, err := promsql.NewQuery(namedQuery, db).ExecContext(ctx, "update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(tenants()).To(ConsistOf("", "acme"))
+	})
+
+	It("should expose the metrics of the calls without a context on the named query", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{
+			Labels: []string{"tenant"},
+		})
+		namedQuery := collector.NewNamedQuery("users")
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(namedQuery, db).Exec("update users set name = 'john'")
+		Expect(err).ShouldNot(HaveOccurred())
+		ctx := promsql.WithQueryLabels(context.Background(), prometheus.Labels{"tenant": "acme"})
+		_, err = promsql.NewQuery(namedQuery, db).ExecContext(ctx, "update users set name = 'jane'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var metric dto.Metric
+		Expect(namedQuery.TotalCalls.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.TotalSuccess.Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(namedQuery.Duration.WithLabelValues("success").(prometheus.Metric).Write(&metric)).To(Succeed())
+		Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+		Expect(queryCounterValue(collector, "namedqry_total_calls", prometheus.Labels{"name": "users", "tenant": "acme"})).To(BeEquivalentTo(1))
+	})
+
+	It("should panic when the label is not declared", func() {
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{})
+		Expect(func() {
+			collector.NewNamedQuery("users", prometheus.Labels{"tenant": "acme"})
+		}).To(Panic())
+	})
+})
+
+// queryCounterValue gathers the counter `name` with exactly the given labels.
+func queryCounterValue(collector prometheus.Collector, name string, labels prometheus.Labels) float64 {
+	registry := prometheus.NewRegistry()
+	Expect(registry.Register(collector)).To(Succeed())
+	families, err := registry.Gather()
+	Expect(err).ShouldNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, pair := range metric.GetLabel() {
+				if value, ok := labels[pair.GetName()]; !ok || value != pair.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	Fail("metric " + name + " not found")
+	return 0
+}
@@ -0,0 +1,73 @@
+package promsql
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UnnamedQuery is the `name` label value used by the `DriverCollector` when
+// the context of a statement does not carry a query name.
+const UnnamedQuery = "unnamed"
+
+type queryNameKey struct{}
+
+// WithQueryName returns a copy of `ctx` carrying the given query name. When
+// the context is passed to `sql.DB.QueryContext`, `sql.DB.ExecContext` (or
+// their `sql.Tx` and `sql.Stmt` counterparts), the `DriverCollector` uses the
+// name as the `name` label of its metrics.
+//
+// Example:
+//
+// ```
+// rs, err := db.QueryContext(promsql.WithQueryName(ctx, "fetch_users"), "SELECT ...")
+// ```
+func WithQueryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, queryNameKey{}, name)
+}
+
+// QueryName returns the query name stored in `ctx` by `WithQueryName`. If
+// there is none, `UnnamedQuery` is returned.
+func QueryName(ctx context.Context) string {
+	if ctx != nil {
+		if name, ok := ctx.Value(queryNameKey{}).(string); ok && name != "" {
+			return name
+		}
+	}
+	return UnnamedQuery
+}
+
+type queryLabelsKey struct{}
+
+// WithQueryLabels returns a copy of `ctx` carrying values for the extra labels
+// declared by `QueryCollectorOpts.Labels`, merged with the ones already
+// carried by `ctx`. The `Query` methods receiving the context use them for
+// the labels not given to `QueryCollector.NewNamedQuery`.
+//
+// Example:
+//
+// ```
+// ctx = promsql.WithQueryLabels(ctx, prometheus.Labels{"tenant": tenantID})
+// rs, err := nqFetchUsers(db).QueryContext(ctx, "SELECT ...")
+// ```
+func WithQueryLabels(ctx context.Context, labels prometheus.Labels) context.Context {
+	merged := make(prometheus.Labels, len(labels))
+	if parent, ok := ctx.Value(queryLabelsKey{}).(prometheus.Labels); ok {
+		for label, value := range parent {
+			merged[label] = value
+		}
+	}
+	for label, value := range labels {
+		merged[label] = value
+	}
+	return context.WithValue(ctx, queryLabelsKey{}, merged)
+}
+
+// queryLabels returns the labels stored in `ctx` by `WithQueryLabels`.
+func queryLabels(ctx context.Context) prometheus.Labels {
+	if ctx == nil {
+		return nil
+	}
+	labels, _ := ctx.Value(queryLabelsKey{}).(prometheus.Labels)
+	return labels
+}
@@ -0,0 +1,12 @@
+//go:build go1.15
+// +build go1.15
+
+package promsql
+
+import "database/sql"
+
+// rowQueryErr returns the error of the query of the row, apart from the
+// errors of `Scan` itself, using `sql.Row.Err`, available from Go 1.15 on.
+func rowQueryErr(row *sql.Row) (error, bool) {
+	return row.Err(), true
+}
@@ -0,0 +1,12 @@
+//go:build !go1.15
+// +build !go1.15
+
+package promsql
+
+import "database/sql"
+
+// rowQueryErr reports that the error of the query of the row cannot be told
+// apart from the errors of `Scan` before Go 1.15.
+func rowQueryErr(row *sql.Row) (error, bool) {
+	return nil, false
+}
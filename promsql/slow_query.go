@@ -0,0 +1,133 @@
+package promsql
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Logger is the minimal interface the slow query log needs. Note that
+// log.Logger from the standard library implements this interface, and it is
+// easy to implement by custom loggers, if they don't do so already anyway.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// SlowQuery describes a statement that took longer than the slow query
+// threshold.
+type SlowQuery struct {
+	// Name is the query name, when known. See `WithQueryName` and
+	// `QueryCollector.NamedQuery`.
+	Name string
+	// Query is the statement executed.
+	Query string
+	// Args are the arguments of the statement, as returned by the
+	// ArgsRedactor, so no sensitive values are reported.
+	Args []string
+	// Duration is how long the statement took.
+	Duration time.Duration
+	// Err is the error returned by the statement, if any.
+	Err error
+}
+
+// String formats the slow query as a single log line.
+func (q SlowQuery) String() string {
+	s := fmt.Sprintf("slow query: name=%s duration=%s query=%q args=[%s]", q.Name, q.Duration, q.Query, strings.Join(q.Args, ", "))
+	if q.Err != nil {
+		s += fmt.Sprintf(" error=%q", q.Err.Error())
+	}
+	return s
+}
+
+// ArgsRedactor returns the representation of the arguments of a statement
+// reported by the slow query log.
+type ArgsRedactor func(args []interface{}) []string
+
+// RedactArgs replaces every argument by `?`, only keeping how many arguments
+// were passed. It is the default ArgsRedactor.
+func RedactArgs(args []interface{}) []string {
+	redacted := make([]string, len(args))
+	for i := range args {
+		redacted[i] = "?"
+	}
+	return redacted
+}
+
+// HashArgs replaces every argument by a short hash of its value, so
+// occurrences of the same value can be correlated without disclosing it.
+// Nil arguments are reported as `NULL`.
+func HashArgs(args []interface{}) []string {
+	hashed := make([]string, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			hashed[i] = "NULL"
+			continue
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%T:%v", arg, arg)))
+		hashed[i] = hex.EncodeToString(sum[:6])
+	}
+	return hashed
+}
+
+// SlowQueryOpts configures the slow query log. The zero value disables it.
+type SlowQueryOpts struct {
+	// Threshold is the duration from which statements are reported. If
+	// zero, the slow query log is disabled.
+	Threshold time.Duration
+	// Logger receives the slow queries formatted by `SlowQuery.String`.
+	Logger Logger
+	// Callback receives the slow queries.
+	Callback func(SlowQuery)
+	// ArgsRedactor defines how arguments are reported. Defaults to
+	// RedactArgs.
+	ArgsRedactor ArgsRedactor
+}
+
+// slowQueryLog reports the statements slower than the threshold.
+type slowQueryLog struct {
+	SlowQueryOpts
+}
+
+// newSlowQueryLog returns nil when the slow query log is disabled.
+func newSlowQueryLog(opts SlowQueryOpts) *slowQueryLog {
+	if opts.Threshold <= 0 {
+		return nil
+	}
+	if opts.ArgsRedactor == nil {
+		opts.ArgsRedactor = RedactArgs
+	}
+	return &slowQueryLog{opts}
+}
+
+// isSlow checks if a statement that took `duration` must be reported.
+func (l *slowQueryLog) isSlow(duration time.Duration) bool {
+	return l != nil && duration >= l.Threshold
+}
+
+// report sends the slow statement to the logger and the callback.
+func (l *slowQueryLog) report(name, query string, args []interface{}, duration time.Duration, err error) {
+	q := SlowQuery{
+		Name:     name,
+		Query:    query,
+		Args:     l.ArgsRedactor(args),
+		Duration: duration,
+		Err:      err,
+	}
+	if l.Logger != nil {
+		l.Logger.Println(q.String())
+	}
+	if l.Callback != nil {
+		l.Callback(q)
+	}
+}
+
+func namedValuesToInterfaces(named []driver.NamedValue) []interface{} {
+	args := make([]interface{}, len(named))
+	for i, arg := range named {
+		args[i] = arg.Value
+	}
+	return args
+}
@@ -0,0 +1,443 @@
+package promsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of the metrics exported from the columns of a `MetricsQuery`.
+const (
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter"
+)
+
+// defaultMetricsQueryTimeout is the timeout of the metrics queries when
+// neither MetricsQuery.Timeout nor SQLMetricsCollectorOpts.Timeout are set.
+const defaultMetricsQueryTimeout = 10 * time.Second
+
+var sqlMetricsCollectorLabels = []string{"query"}
+
+// MetricDefinition maps the columns of the rows returned by a `MetricsQuery`
+// to a metric. Each row is a sample.
+type MetricDefinition struct {
+	// Name is the name of the metric.
+	Name string `yaml:"name"`
+	// Help is the description of the metric. Defaults to a description
+	// naming the query.
+	Help string `yaml:"help"`
+	// Type is MetricTypeGauge (default) or MetricTypeCounter.
+	Type string `yaml:"type"`
+	// Value is the column holding the value of the sample. Rows with a NULL
+	// value are skipped.
+	Value string `yaml:"value"`
+	// Labels are the columns whose values become labels, named after the
+	// columns.
+	Labels []string `yaml:"labels"`
+	// ConstLabels are added to every sample of the metric.
+	ConstLabels map[string]string `yaml:"const_labels"`
+}
+
+// MetricsQuery is a SELECT statement whose results are exported as metrics.
+type MetricsQuery struct {
+	// Name identifies the query in the `query` label of the errors counter.
+	Name string `yaml:"name"`
+	// SQL is the statement executed.
+	SQL string `yaml:"sql"`
+	// Timeout limits how long the statement can take. Defaults to
+	// SQLMetricsCollectorOpts.Timeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheFor keeps the results for the given duration, so scrapes in
+	// between do not hit the database. Ignored when
+	// SQLMetricsCollectorOpts.Interval is set.
+	CacheFor time.Duration `yaml:"cache_for"`
+	// Metrics are the metrics read from each row.
+	Metrics []MetricDefinition `yaml:"metrics"`
+}
+
+// ParseMetricsQueries parses a YAML (or JSON) document with the list of
+// queries:
+//
+//	queries:
+//	  - name: jobs
+//	    sql: SELECT queue, count(*) AS depth FROM jobs GROUP BY queue
+//	    timeout: 5s
+//	    cache_for: 30s
+//	    metrics:
+//	      - name: app_queue_depth
+//	        help: The number of jobs waiting in the queue.
+//	        value: depth
+//	        labels: [queue]
+func ParseMetricsQueries(data []byte) ([]MetricsQuery, error) {
+	var document struct {
+		Queries []MetricsQuery `yaml:"queries"`
+	}
+	if err := yaml.UnmarshalStrict(data, &document); err != nil {
+		return nil, fmt.Errorf("promsql: invalid metrics queries: %v", err)
+	}
+	return document.Queries, nil
+}
+
+// LoadMetricsQueriesFile parses the YAML (or JSON) file at `name`. See
+// `ParseMetricsQueries`.
+func LoadMetricsQueriesFile(name string) ([]MetricsQuery, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetricsQueries(data)
+}
+
+// SQLMetricsCollectorOpts is the input option for SQLMetricsCollector.
+type SQLMetricsCollectorOpts struct {
+	// Prefix is added to the name of the errors counter. The name of the
+	// metrics defined by the queries is kept as is.
+	Prefix string
+	// Queries are the statements executed.
+	Queries []MetricsQuery
+	// Timeout is the default timeout of the queries (default 10 seconds).
+	Timeout time.Duration
+	// Interval makes the queries run in background, every `Interval`, once
+	// the collector is started, instead of at scrape time. Scrapes report
+	// the results of the last run.
+	Interval time.Duration
+}
+
+// SQLMetricsCollector exports the results of user-defined SELECT statements
+// as metrics, such as the depth of a job queue kept in the database.
+//
+// By default, the statements run when the collector is scraped. With
+// SQLMetricsCollectorOpts.Interval, they run in background between `Start`
+// and `Stop`, following the `rscsrv.Startable` interface.
+type SQLMetricsCollector struct {
+	db       *sql.DB
+	interval time.Duration
+	queries  []*metricsQuery
+
+	ErrorsCounter *prometheus.CounterVec
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type metricsQuery struct {
+	MetricsQuery
+	metrics []*metricsQueryMetric
+
+	// refreshing serializes the refreshes of the query, so concurrent
+	// scrapes missing the cache run it once. mu only guards the results, so
+	// they can be collected while the query runs.
+	refreshing sync.Mutex
+	mu         sync.Mutex
+	results    []prometheus.Metric
+	updatedAt  time.Time
+}
+
+type metricsQueryMetric struct {
+	MetricDefinition
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// NewSQLMetricsCollector returns a new instance of *SQLMetricsCollector
+// running the queries against `db`. An error is returned if a query is not
+// properly defined.
+func NewSQLMetricsCollector(db *sql.DB, opts SQLMetricsCollectorOpts) (*SQLMetricsCollector, error) {
+	prefix := opts.Prefix
+	if prefix != "" && !strings.HasSuffix(opts.Prefix, "_") {
+		prefix += "_"
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultMetricsQueryTimeout
+	}
+
+	collector := &SQLMetricsCollector{
+		db:       db,
+		interval: opts.Interval,
+		ErrorsCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("db_%smetrics_query_errors_total", prefix),
+				Help: "The total number of metrics queries that failed",
+			},
+			sqlMetricsCollectorLabels,
+		),
+	}
+
+	names := make(map[string]bool, len(opts.Queries))
+	for _, q := range opts.Queries {
+		if q.Name == "" {
+			return nil, errors.New("promsql: metrics query without name")
+		}
+		if names[q.Name] {
+			return nil, fmt.Errorf("promsql: metrics query %q defined more than once", q.Name)
+		}
+		names[q.Name] = true
+		if strings.TrimSpace(q.SQL) == "" {
+			return nil, fmt.Errorf("promsql: metrics query %q without sql", q.Name)
+		}
+		if len(q.Metrics) == 0 {
+			return nil, fmt.Errorf("promsql: metrics query %q without metrics", q.Name)
+		}
+		if q.Timeout <= 0 {
+			q.Timeout = timeout
+		}
+
+		query := &metricsQuery{MetricsQuery: q}
+		for _, m := range q.Metrics {
+			metric, err := newMetricsQueryMetric(q.Name, m)
+			if err != nil {
+				return nil, err
+			}
+			query.metrics = append(query.metrics, metric)
+		}
+		collector.queries = append(collector.queries, query)
+		collector.ErrorsCounter.WithLabelValues(q.Name)
+	}
+	return collector, nil
+}
+
+func newMetricsQueryMetric(query string, m MetricDefinition) (*metricsQueryMetric, error) {
+	if !model.IsValidMetricName(model.LabelValue(m.Name)) {
+		return nil, fmt.Errorf("promsql: metrics query %q: invalid metric name %q", query, m.Name)
+	}
+	if m.Value == "" {
+		return nil, fmt.Errorf("promsql: metrics query %q: metric %q without value column", query, m.Name)
+	}
+	for _, label := range m.Labels {
+		if !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("promsql: metrics query %q: metric %q: invalid label %q", query, m.Name, label)
+		}
+	}
+
+	metric := &metricsQueryMetric{MetricDefinition: m}
+	switch m.Type {
+	case "", MetricTypeGauge:
+		metric.valueType = prometheus.GaugeValue
+	case MetricTypeCounter:
+		metric.valueType = prometheus.CounterValue
+	default:
+		return nil, fmt.Errorf("promsql: metrics query %q: metric %q: invalid type %q", query, m.Name, m.Type)
+	}
+	help := m.Help
+	if help == "" {
+		help = fmt.Sprintf("Metric read from the %q metrics query.", query)
+	}
+	metric.desc = prometheus.NewDesc(m.Name, help, m.Labels, m.ConstLabels)
+	return metric, nil
+}
+
+// Describe implements the prometheus.Collector interface.
+func (collector *SQLMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	collector.ErrorsCounter.Describe(ch)
+	for _, q := range collector.queries {
+		for _, m := range q.metrics {
+			ch <- m.desc
+		}
+	}
+}
+
+// Collect implements the prometheus.Collector interface. Unless the
+// collector runs in background, the queries not cached are executed
+// concurrently.
+func (collector *SQLMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	if collector.interval <= 0 {
+		var wg sync.WaitGroup
+		for _, q := range collector.queries {
+			wg.Add(1)
+			go func(q *metricsQuery) {
+				defer wg.Done()
+				collector.refresh(context.Background(), q, false)
+			}(q)
+		}
+		wg.Wait()
+	}
+
+	for _, q := range collector.queries {
+		q.mu.Lock()
+		results := q.results
+		q.mu.Unlock()
+		for _, metric := range results {
+			ch <- metric
+		}
+	}
+	collector.ErrorsCounter.Collect(ch)
+}
+
+// refresh runs the query, unless its results are still cached. Failures are
+// counted and clear the previous results, so stale values are not reported.
+func (collector *SQLMetricsCollector) refresh(ctx context.Context, q *metricsQuery, force bool) {
+	q.refreshing.Lock()
+	defer q.refreshing.Unlock()
+
+	q.mu.Lock()
+	cached := !q.updatedAt.IsZero() && time.Since(q.updatedAt) < q.CacheFor
+	q.mu.Unlock()
+	if !force && cached {
+		return
+	}
+
+	results, err := collector.run(ctx, q)
+	if err != nil && ctx.Err() != nil {
+		// The collector was stopped in the middle of the query.
+		return
+	}
+	if err != nil {
+		collector.ErrorsCounter.WithLabelValues(q.Name).Inc()
+		results = nil
+	}
+	q.mu.Lock()
+	q.results = results
+	q.updatedAt = time.Now()
+	q.mu.Unlock()
+}
+
+// run executes the query, converting each row into one sample of each of
+// its metrics.
+func (collector *SQLMetricsCollector) run(ctx context.Context, q *metricsQuery) ([]prometheus.Metric, error) {
+	ctx, cancel := context.WithTimeout(ctx, q.Timeout)
+	defer cancel()
+
+	rows, err := collector.db.QueryContext(ctx, q.SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[strings.ToLower(column)] = i
+	}
+	column := func(name string) (int, error) {
+		i, ok := index[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("promsql: metrics query %q: column %q not found", q.Name, name)
+		}
+		return i, nil
+	}
+	for _, m := range q.metrics {
+		if _, err := column(m.Value); err != nil {
+			return nil, err
+		}
+		for _, label := range m.Labels {
+			if _, err := column(label); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var (
+		results []prometheus.Metric
+		values  = make([]sql.NullString, len(columns))
+		dest    = make([]interface{}, len(columns))
+	)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for _, m := range q.metrics {
+			i, _ := column(m.Value)
+			if !values[i].Valid {
+				continue
+			}
+			value, err := strconv.ParseFloat(values[i].String, 64)
+			if err != nil {
+				return nil, fmt.Errorf("promsql: metrics query %q: column %q is not a number: %v", q.Name, m.Value, err)
+			}
+			labels := make([]string, len(m.Labels))
+			for j, label := range m.Labels {
+				i, _ := column(label)
+				labels[j] = values[i].String
+			}
+			metric, err := prometheus.NewConstMetric(m.desc, m.valueType, value, labels...)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, metric)
+		}
+	}
+	return results, rows.Err()
+}
+
+// Start implements the rscsrv.Startable interface. When
+// SQLMetricsCollectorOpts.Interval is set, the queries start running in
+// background. Otherwise, it is a no-op.
+func (collector *SQLMetricsCollector) Start() error {
+	if collector.interval <= 0 {
+		return nil
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if collector.cancel != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	collector.cancel, collector.done = cancel, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(collector.interval)
+		defer ticker.Stop()
+		for {
+			collector.refreshAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (collector *SQLMetricsCollector) refreshAll(ctx context.Context) {
+	for _, q := range collector.queries {
+		if ctx.Err() != nil {
+			return
+		}
+		collector.refresh(ctx, q, true)
+	}
+}
+
+// Stop implements the rscsrv.Startable interface, waiting for the queries
+// running in background to finish.
+func (collector *SQLMetricsCollector) Stop() error {
+	collector.mu.Lock()
+	cancel, done := collector.cancel, collector.done
+	collector.cancel, collector.done = nil, nil
+	collector.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// Restart implements the rscsrv.Startable interface.
+func (collector *SQLMetricsCollector) Restart() error {
+	if err := collector.Stop(); err != nil {
+		return err
+	}
+	return collector.Start()
+}
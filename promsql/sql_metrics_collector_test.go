@@ -0,0 +1,212 @@
+package promsql_test
+
+import (
+	"database/sql/driver"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+// gatherFamilies registers the collector in a new registry and gathers it,
+// indexing the metric families by name.
+func gatherFamilies(collector prometheus.Collector) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	Expect(registry.Register(collector)).To(Succeed())
+	families, err := registry.Gather()
+	Expect(err).ShouldNot(HaveOccurred())
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+var _ = Describe("SQL Metrics Collector", func() {
+	queueDepth := promsql.MetricsQuery{
+		Name: "jobs",
+		SQL:  "SELECT queue, depth, processed FROM jobs",
+		Metrics: []promsql.MetricDefinition{
+			{Name: "app_queue_depth", Value: "depth", Labels: []string{"queue"}},
+			{Name: "app_jobs_processed_total", Type: promsql.MetricTypeCounter, Value: "processed", Labels: []string{"queue"}, ConstLabels: map[string]string{"app": "worker"}},
+		},
+	}
+	jobsDriver := func() *fakeDriver {
+		return &fakeDriver{
+			columns: []string{"queue", "depth", "processed"},
+			values: [][]driver.Value{
+				{"emails", int64(3), int64(10)},
+				{"reports", 1.5, nil},
+			},
+		}
+	}
+
+	It("should parse the queries from YAML", func() {
+		queries, err := promsql.ParseMetricsQueries([]byte(`
+queries:
+  - name: jobs
+    sql: SELECT queue, count(*) AS depth FROM jobs GROUP BY queue
+    timeout: 5s
+    cache_for: 30s
+    metrics:
+      - name: app_queue_depth
+        value: depth
+        labels: [queue]
+`))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(queries).To(Equal([]promsql.MetricsQuery{{
+			Name:     "jobs",
+			SQL:      "SELECT queue, count(*) AS depth FROM jobs GROUP BY queue",
+			Timeout:  5 * time.Second,
+			CacheFor: 30 * time.Second,
+			Metrics: []promsql.MetricDefinition{
+				{Name: "app_queue_depth", Value: "depth", Labels: []string{"queue"}},
+			},
+		}}))
+	})
+
+	It("should parse the queries from JSON", func() {
+		queries, err := promsql.ParseMetricsQueries([]byte(`{"queries": [{"name": "jobs", "sql": "SELECT 1 AS one", "timeout": "1s", "metrics": [{"name": "app_one", "value": "one"}]}]}`))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(queries).To(HaveLen(1))
+		Expect(queries[0].Timeout).To(Equal(time.Second))
+
+		_, err = promsql.ParseMetricsQueries([]byte(`{"queries": [{"nam": "jobs"}]}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail on invalid definitions", func() {
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Queries: []promsql.MetricsQuery{queueDepth, queueDepth},
+		})
+		Expect(err).To(MatchError(`promsql: metrics query "jobs" defined more than once`))
+
+		_, err = promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Queries: []promsql.MetricsQuery{{Name: "jobs", SQL: "SELECT 1", Metrics: []promsql.MetricDefinition{{Name: "app-one", Value: "one"}}}},
+		})
+		Expect(err).To(MatchError(`promsql: metrics query "jobs": invalid metric name "app-one"`))
+
+		_, err = promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Queries: []promsql.MetricsQuery{{Name: "jobs", SQL: "SELECT 1", Metrics: []promsql.MetricDefinition{{Name: "app_one", Value: "one", Type: "summary"}}}},
+		})
+		Expect(err).To(MatchError(`promsql: metrics query "jobs": metric "app_one": invalid type "summary"`))
+	})
+
+	It("should export the columns as metrics", func() {
+		db := openFakeDB(jobsDriver())
+		defer db.Close()
+		collector, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Queries: []promsql.MetricsQuery{queueDepth},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		families := gatherFamilies(collector)
+		depth := families["app_queue_depth"]
+		Expect(depth.GetType()).To(Equal(dto.MetricType_GAUGE))
+		Expect(depth.GetMetric()).To(HaveLen(2))
+		Expect(depth.GetMetric()[0].GetLabel()[0].GetValue()).To(Equal("emails"))
+		Expect(depth.GetMetric()[0].GetGauge().GetValue()).To(BeEquivalentTo(3))
+		Expect(depth.GetMetric()[1].GetGauge().GetValue()).To(BeEquivalentTo(1.5))
+
+		processed := families["app_jobs_processed_total"]
+		Expect(processed.GetType()).To(Equal(dto.MetricType_COUNTER))
+		Expect(processed.GetMetric()).To(HaveLen(1))
+		Expect(processed.GetMetric()[0].GetLabel()).To(HaveLen(2))
+		Expect(processed.GetMetric()[0].GetCounter().GetValue()).To(BeEquivalentTo(10))
+
+		Expect(families["db_metrics_query_errors_total"].GetMetric()[0].GetCounter().GetValue()).To(BeEquivalentTo(0))
+	})
+
+	It("should cache the results", func() {
+		d := jobsDriver()
+		db := openFakeDB(d)
+		defer db.Close()
+		query := queueDepth
+		query.CacheFor = time.Hour
+		collector, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Queries: []promsql.MetricsQuery{query},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		gatherFamilies(collector)
+		families := gatherFamilies(collector)
+		Expect(families["app_queue_depth"].GetMetric()).To(HaveLen(2))
+		Expect(atomic.LoadInt64(&d.queries)).To(BeEquivalentTo(1))
+	})
+
+	It("should count failures and timeouts", func() {
+		db := openFakeDB(jobsDriver())
+		defer db.Close()
+		collector, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Timeout: 10 * time.Millisecond,
+			Queries: []promsql.MetricsQuery{
+				{Name: "failing", SQL: "SELECT fail", Metrics: []promsql.MetricDefinition{{Name: "app_failing", Value: "depth"}}},
+				{Name: "sleeping", SQL: "SELECT sleep", Metrics: []promsql.MetricDefinition{{Name: "app_sleeping", Value: "depth"}}},
+				{Name: "missing", SQL: "SELECT queue FROM jobs", Metrics: []promsql.MetricDefinition{{Name: "app_missing", Value: "missing"}}},
+			},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		families := gatherFamilies(collector)
+		Expect(families).ToNot(HaveKey("app_failing"))
+		Expect(families).ToNot(HaveKey("app_sleeping"))
+		Expect(families).ToNot(HaveKey("app_missing"))
+		errors := families["db_metrics_query_errors_total"].GetMetric()
+		Expect(errors).To(HaveLen(3))
+		for _, metric := range errors {
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		}
+	})
+
+	It("should run the queries in background when started", func() {
+		d := jobsDriver()
+		db := openFakeDB(d)
+		defer db.Close()
+		collector, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Interval: time.Hour,
+			Queries:  []promsql.MetricsQuery{queueDepth},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(gatherFamilies(collector)).ToNot(HaveKey("app_queue_depth"))
+
+		Expect(collector.Start()).To(Succeed())
+		Eventually(func() int64 { return atomic.LoadInt64(&d.queries) }).Should(BeEquivalentTo(1))
+		Expect(collector.Stop()).To(Succeed())
+
+		Expect(gatherFamilies(collector)["app_queue_depth"].GetMetric()).To(HaveLen(2))
+		Expect(atomic.LoadInt64(&d.queries)).To(BeEquivalentTo(1))
+	})
+	It("should not block the scrapes while a query runs in background", func() {
+		d := jobsDriver()
+		db := openFakeDB(d)
+		defer db.Close()
+		collector, err := promsql.NewSQLMetricsCollector(db, promsql.SQLMetricsCollectorOpts{
+			Interval: time.Hour,
+			Timeout:  time.Minute,
+			Queries: []promsql.MetricsQuery{
+				{Name: "sleeping", SQL: "SELECT sleep", Metrics: []promsql.MetricDefinition{{Name: "app_sleeping", Value: "depth"}}},
+			},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(collector.Start()).To(Succeed())
+		defer collector.Stop()
+		Eventually(func() int64 { return atomic.LoadInt64(&d.queries) }).Should(BeEquivalentTo(1))
+
+		gathered := make(chan map[string]*dto.MetricFamily)
+		go func() {
+			defer GinkgoRecover()
+			gathered <- gatherFamilies(collector)
+		}()
+		Eventually(gathered, time.Second).Should(Receive(Not(HaveKey("app_sleeping"))))
+	})
+})
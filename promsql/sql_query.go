@@ -3,6 +3,7 @@ package promsql
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 )
 
@@ -30,91 +31,337 @@ type DBQueryProxy interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
+// DBQueryRower is implemented by the DBQueryProxy instances that can query a
+// single row, such as `sql.DB` and `sql.Tx`.
+type DBQueryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// DBPreparer is implemented by the DBQueryProxy instances that can prepare
+// statements, such as `sql.DB` and `sql.Tx`.
+type DBPreparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// DBTxBeginner is implemented by the DBQueryProxy instances that can begin
+// transactions, such as `sql.DB`.
+type DBTxBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+var (
+	// ErrQueryRowNotSupported is returned by the `Row.Scan` of
+	// `Query.QueryRow` when the DBQueryProxy cannot query a single row.
+	ErrQueryRowNotSupported = errors.New("promsql: the query proxy cannot query a single row")
+	// ErrPrepareNotSupported is returned by `Query.Prepare` when the
+	// DBQueryProxy cannot prepare statements.
+	ErrPrepareNotSupported = errors.New("promsql: the query proxy cannot prepare statements")
+	// ErrBeginTxNotSupported is returned by `Query.BeginTx` when the
+	// DBQueryProxy cannot begin transactions (e.g. it is a `sql.Tx` already).
+	ErrBeginTxNotSupported = errors.New("promsql: the query proxy cannot begin transactions")
+)
+
 // Query is a proxy to `sql.DB.Query` that add some logic to count the number of
 // times the method was called, how many times it succeeded or failed and how
 // long it took.
 func (srv *Query) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	srv.namedQuery.TotalCalls.Inc()
-
-	start := time.Now()
-	res, err := srv.db.Query(query, args...)
-	srv.namedQuery.TotalDuration.Add(time.Since(start).Seconds())
-
-	if err != nil {
-		srv.namedQuery.TotalFailures.Inc()
-	} else {
-		srv.namedQuery.TotalSuccess.Inc()
-	}
-
-	return res, err
+	return srv.namedQuery.withoutContext().query(query, args, func() (*sql.Rows, error) {
+		return srv.db.Query(query, args...)
+	})
 }
 
 // QueryContext is a proxy to `sql.DB.QueryContext` that add some logic to count
 // the number of times the method was called, how many times it succeeded or
 // failed and how long it took.
 func (srv *Query) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	srv.namedQuery.TotalCalls.Inc()
-
-	start := time.Now()
-	res, err := srv.db.QueryContext(ctx, query, args...)
-	srv.namedQuery.TotalDuration.Add(time.Since(start).Seconds())
+	return srv.namedQuery.forContext(ctx).query(query, args, func() (*sql.Rows, error) {
+		return srv.db.QueryContext(ctx, query, args...)
+	})
+}
 
-	if err != nil {
-		srv.namedQuery.TotalFailures.Inc()
-	} else {
-		srv.namedQuery.TotalSuccess.Inc()
+// QueryRow is a proxy to `sql.DB.QueryRow`. As the outcome of the query is
+// only known when the row is scanned, the metrics are recorded by
+// `Row.Scan`: a Row that is never scanned only counts the call.
+// `sql.ErrNoRows` is counted apart, neither as a success nor as a failure.
+//
+// If the DBQueryProxy cannot query a single row, `Row.Scan` returns
+// ErrQueryRowNotSupported.
+func (srv *Query) QueryRow(query string, args ...interface{}) *Row {
+	rower, ok := srv.db.(DBQueryRower)
+	if !ok {
+		return srv.namedQuery.withoutContext().queryRowNotSupported(query, args)
 	}
+	return srv.namedQuery.withoutContext().queryRow(query, args, func() *sql.Row {
+		return rower.QueryRow(query, args...)
+	})
+}
 
-	return res, err
+// QueryRowContext is a proxy to `sql.DB.QueryRowContext`. See `QueryRow`.
+func (srv *Query) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	rower, ok := srv.db.(DBQueryRower)
+	if !ok {
+		return srv.namedQuery.forContext(ctx).queryRowNotSupported(query, args)
+	}
+	return srv.namedQuery.forContext(ctx).queryRow(query, args, func() *sql.Row {
+		return rower.QueryRowContext(ctx, query, args...)
+	})
 }
 
 // Exec is a proxy to `sql.DB.Exec` that add some logic to count the number of
 // times the method was called, how many times it succeeded or failed and how
 // long it took.
 func (srv *Query) Exec(Exec string, args ...interface{}) (sql.Result, error) {
-	srv.namedQuery.TotalCalls.Inc()
+	return srv.namedQuery.withoutContext().exec(Exec, args, func() (sql.Result, error) {
+		return srv.db.Exec(Exec, args...)
+	})
+}
 
-	start := time.Now()
-	res, err := srv.db.Exec(Exec, args...)
-	srv.namedQuery.TotalDuration.Add(time.Since(start).Seconds())
+// ExecContext is a proxy to `sql.DB.ExecContext` that add some logic to count
+// the number of times the method was called, how many times it succeeded or
+// failed and how long it took.
+func (srv *Query) ExecContext(ctx context.Context, Exec string, args ...interface{}) (sql.Result, error) {
+	return srv.namedQuery.forContext(ctx).exec(Exec, args, func() (sql.Result, error) {
+		return srv.db.ExecContext(ctx, Exec, args...)
+	})
+}
 
+// Prepare is a proxy to `sql.DB.Prepare` returning a statement whose
+// executions are counted under the name of the query. If the DBQueryProxy
+// cannot prepare statements, ErrPrepareNotSupported is returned.
+func (srv *Query) Prepare(query string) (*Stmt, error) {
+	preparer, ok := srv.db.(DBPreparer)
+	if !ok {
+		return nil, ErrPrepareNotSupported
+	}
+	stmt, err := preparer.Prepare(query)
 	if err != nil {
-		srv.namedQuery.TotalFailures.Inc()
-	} else {
-		rowsAffected, rowErr := res.RowsAffected()
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, namedQuery: srv.namedQuery, query: query}, nil
+}
 
-		if rowErr != nil {
-			srv.namedQuery.TotalFailures.Inc()
-		} else {
-			srv.namedQuery.TotalSuccess.Inc()
-			srv.namedQuery.TotalRowsAffected.Add(float64(rowsAffected))
+// PrepareContext is a proxy to `sql.DB.PrepareContext`. See `Prepare`.
+func (srv *Query) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	preparer, ok := srv.db.(DBPreparer)
+	if !ok {
+		return nil, ErrPrepareNotSupported
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, namedQuery: srv.namedQuery, query: query}, nil
+}
+
+// BeginTx is a proxy to `sql.DB.BeginTx` returning a transaction whose
+// commits and rollbacks are counted under the name of the query. If the
+// DBQueryProxy cannot begin transactions, ErrBeginTxNotSupported is returned.
+func (srv *Query) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	beginner, ok := srv.db.(DBTxBeginner)
+	if !ok {
+		return nil, ErrBeginTxNotSupported
+	}
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, namedQuery: srv.namedQuery.forContext(ctx)}, nil
+}
+
+// Row is the result of `Query.QueryRow`. It records the metrics of the query
+// when scanned.
+type Row struct {
+	row        *sql.Row
+	err        error
+	namedQuery *NamedQuery
+	query      string
+	args       []interface{}
+	duration   time.Duration
+	scanned    bool
+}
+
+// Scan is a proxy to `sql.Row.Scan` that records the outcome of the query on
+// the first call. The errors converting the columns into `dest` are not
+// failures of the query (from Go 1.15 on, see `sql.Row.Err`).
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		r.record(r.err)
+		return r.err
+	}
+
+	err := r.row.Scan(dest...)
+	outcome := err
+	if err != nil && err != sql.ErrNoRows {
+		if queryErr, ok := rowQueryErr(r.row); ok {
+			outcome = queryErr
 		}
 	}
+	r.record(outcome)
+	return err
+}
+
+// record records the outcome of the query, once.
+func (r *Row) record(err error) {
+	if r.scanned {
+		return
+	}
+	r.scanned = true
 
-	return res, err
+	switch err {
+	case nil:
+		r.namedQuery.observe(r.query, r.args, r.duration, nil)
+		r.namedQuery.TotalSuccess.Inc()
+	case sql.ErrNoRows:
+		r.namedQuery.observeOutcome(r.query, r.args, r.duration, outcomeNoRows, nil)
+		r.namedQuery.TotalNoRows.Inc()
+	default:
+		r.namedQuery.observe(r.query, r.args, r.duration, err)
+		r.namedQuery.failed(err)
+	}
 }
 
-// ExecContext is a proxy to `sql.DB.ExecContext` that add some logic to count
-// the number of times the method was called, how many times it succeeded or
-// failed and how long it took.
-func (srv *Query) ExecContext(ctx context.Context, Exec string, args ...interface{}) (sql.Result, error) {
-	srv.namedQuery.TotalCalls.Inc()
+// Stmt is a prepared statement, returned by `Query.Prepare`, whose executions
+// are counted under the name of the query.
+type Stmt struct {
+	*sql.Stmt
+	namedQuery *NamedQuery
+	query      string
+}
+
+// Query is a proxy to `sql.Stmt.Query`. See `Query.Query`.
+func (s *Stmt) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.namedQuery.withoutContext().query(s.query, args, func() (*sql.Rows, error) {
+		return s.Stmt.Query(args...)
+	})
+}
+
+// QueryContext is a proxy to `sql.Stmt.QueryContext`. See `Query.Query`.
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	return s.namedQuery.forContext(ctx).query(s.query, args, func() (*sql.Rows, error) {
+		return s.Stmt.QueryContext(ctx, args...)
+	})
+}
+
+// QueryRow is a proxy to `sql.Stmt.QueryRow`. See `Query.QueryRow`.
+func (s *Stmt) QueryRow(args ...interface{}) *Row {
+	return s.namedQuery.withoutContext().queryRow(s.query, args, func() *sql.Row {
+		return s.Stmt.QueryRow(args...)
+	})
+}
+
+// QueryRowContext is a proxy to `sql.Stmt.QueryRowContext`. See
+// `Query.QueryRow`.
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *Row {
+	return s.namedQuery.forContext(ctx).queryRow(s.query, args, func() *sql.Row {
+		return s.Stmt.QueryRowContext(ctx, args...)
+	})
+}
+
+// Exec is a proxy to `sql.Stmt.Exec`. See `Query.Exec`.
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.namedQuery.withoutContext().exec(s.query, args, func() (sql.Result, error) {
+		return s.Stmt.Exec(args...)
+	})
+}
+
+// ExecContext is a proxy to `sql.Stmt.ExecContext`. See `Query.Exec`.
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	return s.namedQuery.forContext(ctx).exec(s.query, args, func() (sql.Result, error) {
+		return s.Stmt.ExecContext(ctx, args...)
+	})
+}
+
+// Tx is a transaction, returned by `Query.BeginTx`, whose commits and
+// rollbacks are counted under the name of the query. As it embeds the
+// `sql.Tx`, it can also be used as a DBQueryProxy.
+type Tx struct {
+	*sql.Tx
+	namedQuery *NamedQuery
+}
+
+// Commit is a proxy to `sql.Tx.Commit` that counts the commit.
+func (tx *Tx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.namedQuery.transactionDone(string(OpCommit), err)
+	return err
+}
+
+// Rollback is a proxy to `sql.Tx.Rollback` that counts the rollback. Rolling
+// back a transaction already done (e.g. a deferred rollback after a commit)
+// is not counted.
+func (tx *Tx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if err != sql.ErrTxDone {
+		tx.namedQuery.transactionDone(string(OpRollback), err)
+	}
+	return err
+}
+
+func (nq *NamedQuery) query(query string, args []interface{}, fn func() (*sql.Rows, error)) (*sql.Rows, error) {
+	nq.TotalCalls.Inc()
 
 	start := time.Now()
-	res, err := srv.db.ExecContext(ctx, Exec, args...)
-	srv.namedQuery.TotalDuration.Add(time.Since(start).Seconds())
+	res, err := fn()
+	nq.observe(query, args, time.Since(start), err)
 
 	if err != nil {
-		srv.namedQuery.TotalFailures.Inc()
+		nq.failed(err)
 	} else {
-		rowsAffected, rowErr := res.RowsAffected()
+		nq.TotalSuccess.Inc()
+	}
 
-		if rowErr != nil {
-			srv.namedQuery.TotalFailures.Inc()
-		} else {
-			srv.namedQuery.TotalSuccess.Inc()
-			srv.namedQuery.TotalRowsAffected.Add(float64(rowsAffected))
-		}
+	return res, err
+}
+
+func (nq *NamedQuery) queryRow(query string, args []interface{}, fn func() *sql.Row) *Row {
+	nq.TotalCalls.Inc()
+
+	start := time.Now()
+	row := fn()
+	return &Row{
+		row:        row,
+		namedQuery: nq,
+		query:      query,
+		args:       args,
+		duration:   time.Since(start),
+	}
+}
+
+// queryRowNotSupported returns a Row whose Scan fails with
+// ErrQueryRowNotSupported.
+func (nq *NamedQuery) queryRowNotSupported(query string, args []interface{}) *Row {
+	nq.TotalCalls.Inc()
+	return &Row{
+		err:        ErrQueryRowNotSupported,
+		namedQuery: nq,
+		query:      query,
+		args:       args,
+	}
+}
+
+func (nq *NamedQuery) exec(query string, args []interface{}, fn func() (sql.Result, error)) (sql.Result, error) {
+	nq.TotalCalls.Inc()
+
+	start := time.Now()
+	res, err := fn()
+	duration := time.Since(start)
+
+	if err != nil {
+		nq.observe(query, args, duration, err)
+		nq.failed(err)
+		return res, err
+	}
+
+	rowsAffected, rowErr := res.RowsAffected()
+	nq.observe(query, args, duration, rowErr)
+	if rowErr != nil {
+		nq.failed(rowErr)
+	} else {
+		nq.TotalSuccess.Inc()
+		nq.TotalRowsAffected.Add(float64(rowsAffected))
+		nq.RowsAffected.Observe(float64(rowsAffected))
 	}
 
 	return res, err
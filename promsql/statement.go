@@ -0,0 +1,332 @@
+package promsql
+
+import (
+	"strings"
+	"sync"
+)
+
+// Verbs reported by the `verb` label when statement classification is
+// enabled.
+const (
+	verbSelect = "select"
+	verbInsert = "insert"
+	verbUpdate = "update"
+	verbDelete = "delete"
+	verbDDL    = "ddl"
+	verbOther  = "other"
+)
+
+// OtherFingerprint is the `fingerprint` label value used once the maximum
+// number of distinct fingerprints is reached.
+const OtherFingerprint = "other"
+
+// defaultMaxFingerprints is the number of distinct fingerprints tracked when
+// DriverCollectorOpts.MaxFingerprints is not set.
+const defaultMaxFingerprints = 100
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenQuotedIdentifier
+	tokenString
+	tokenNumber
+	tokenPlaceholder
+	tokenPunctuation
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// tokenize splits a SQL statement into a list of tokens. It is not a full SQL
+// lexer: it only knows enough to skip comments and literals, which is all the
+// classification and fingerprinting needs.
+func tokenize(query string) []token {
+	tokens := make([]token, 0, 16)
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case ch == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+		case ch == '\'':
+			j := i + 1
+			for j < len(query) {
+				if query[j] == '\'' {
+					if j+1 < len(query) && query[j+1] == '\'' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(query) {
+				j = len(query) - 1
+			}
+			tokens = append(tokens, token{tokenString, query[i : j+1]})
+			i = j + 1
+		case ch == '"' || ch == '`':
+			end := strings.IndexByte(query[i+1:], ch)
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			tokens = append(tokens, token{tokenQuotedIdentifier, query[i+1 : i+1+end]})
+			i += end + 2
+		case ch >= '0' && ch <= '9':
+			j := i
+			for j < len(query) && (isDigit(query[j]) || query[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, query[i:j]})
+			i = j
+		case ch == ':' && i+1 < len(query) && query[i+1] == ':':
+			tokens = append(tokens, token{tokenPunctuation, "::"})
+			i += 2
+		case ch == '$' || ch == '?' || ch == ':' && i+1 < len(query) && isWordChar(query[i+1]):
+			j := i + 1
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokenPlaceholder, query[i:j]})
+			i = j
+		case isWordChar(ch):
+			j := i
+			for j < len(query) && (isWordChar(query[j]) || isDigit(query[j]) || query[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, token{tokenWord, query[i:j]})
+			i = j
+		default:
+			tokens = append(tokens, token{tokenPunctuation, query[i : i+1]})
+			i++
+		}
+	}
+	return tokens
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || isDigit(ch) || ch >= 0x80
+}
+
+// isKeyword checks if the token is the given (lowercase) keyword.
+func (t token) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.value, keyword)
+}
+
+// classifyStatement returns the verb of the statement and the table it
+// targets. If the table cannot be determined, an empty string is returned.
+func classifyStatement(query string) (verb string, table string) {
+	return classifyTokens(tokenize(query))
+}
+
+// classifyTokens classifies a statement from its tokens, so they can be
+// shared with fingerprintTokens. See classifyStatement.
+func classifyTokens(tokens []token) (verb string, table string) {
+	if len(tokens) == 0 {
+		return verbOther, ""
+	}
+
+	// Skip common table expressions, the verb is the first keyword after
+	// them at the top level.
+	i := 0
+	if tokens[0].isKeyword("with") {
+		depth := 0
+		for i = 1; i < len(tokens); i++ {
+			t := tokens[i]
+			if t.kind == tokenPunctuation {
+				switch t.value {
+				case "(":
+					depth++
+				case ")":
+					depth--
+				}
+				continue
+			}
+			if depth == 0 && (t.isKeyword("select") || t.isKeyword("insert") || t.isKeyword("update") || t.isKeyword("delete")) {
+				break
+			}
+		}
+		if i == len(tokens) {
+			return verbOther, ""
+		}
+	}
+
+	switch strings.ToLower(tokens[i].value) {
+	case "select":
+		return verbSelect, tableAfter(tokens[i+1:], "from")
+	case "insert":
+		return verbInsert, tableAfter(tokens[i+1:], "into")
+	case "update":
+		return verbUpdate, tableName(tokens[i+1:])
+	case "delete":
+		return verbDelete, tableAfter(tokens[i+1:], "from")
+	case "create", "alter", "drop":
+		return verbDDL, tableAfter(tokens[i+1:], "table")
+	case "truncate":
+		return verbDDL, tableName(tokens[i+1:])
+	}
+	return verbOther, ""
+}
+
+// tableAfter returns the table name following the first top level
+// occurrence of the given keyword.
+func tableAfter(tokens []token, keyword string) string {
+	depth := 0
+	for i, t := range tokens {
+		if t.kind == tokenPunctuation {
+			switch t.value {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			continue
+		}
+		if depth == 0 && t.isKeyword(keyword) {
+			return tableName(tokens[i+1:])
+		}
+	}
+	return ""
+}
+
+// tableName reads a (possibly schema qualified) table name from the
+// beginning of tokens, skipping modifiers such as `ONLY` or `IF EXISTS`.
+func tableName(tokens []token) string {
+	i := 0
+	for i < len(tokens) && (tokens[i].isKeyword("only") || tokens[i].isKeyword("table") || tokens[i].isKeyword("if") || tokens[i].isKeyword("not") || tokens[i].isKeyword("exists")) {
+		i++
+	}
+
+	var name []string
+	for ; i < len(tokens); i++ {
+		switch tokens[i].kind {
+		case tokenWord:
+			name = append(name, strings.ToLower(tokens[i].value))
+		case tokenQuotedIdentifier:
+			name = append(name, tokens[i].value)
+		default:
+			return strings.Join(name, ".")
+		}
+		if i+1 >= len(tokens) || tokens[i+1].kind != tokenPunctuation || tokens[i+1].value != "." {
+			break
+		}
+		i++
+	}
+	return strings.Join(name, ".")
+}
+
+// fingerprintStatement normalizes a statement by replacing its literals and
+// placeholders by `?`, lower casing keywords and collapsing whitespace. Lists
+// of values, such as `IN (1, 2, 3)`, are collapsed into a single `?`.
+func fingerprintStatement(query string) string {
+	return fingerprintTokens(tokenize(query), len(query))
+}
+
+// fingerprintTokens fingerprints a statement from its tokens, so they can be
+// shared with classifyTokens. `size` is the length of the statement, used to
+// size the fingerprint. See fingerprintStatement.
+func fingerprintTokens(tokens []token, size int) string {
+	var (
+		b    strings.Builder
+		prev token
+	)
+	b.Grow(size)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		value := t.value
+		switch t.kind {
+		case tokenWord:
+			value = strings.ToLower(value)
+		case tokenQuotedIdentifier:
+			value = `"` + value + `"`
+		case tokenString, tokenNumber, tokenPlaceholder:
+			value = "?"
+			// Collapse lists of literals: `?, ?, ?` becomes `?`.
+			for i+2 < len(tokens) && tokens[i+1].kind == tokenPunctuation && tokens[i+1].value == "," && isLiteral(tokens[i+2]) {
+				i += 2
+			}
+		}
+
+		if b.Len() > 0 && needsSpace(prev, t) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(value)
+		prev = t
+	}
+	return b.String()
+}
+
+func isLiteral(t token) bool {
+	return t.kind == tokenString || t.kind == tokenNumber || t.kind == tokenPlaceholder
+}
+
+// needsSpace checks if a space must be written between the two tokens.
+func needsSpace(prev, t token) bool {
+	if prev.kind == tokenPunctuation && (prev.value == "(" || prev.value == ".") {
+		return false
+	}
+	if t.kind == tokenPunctuation {
+		switch t.value {
+		case ",", ")", ".", ";":
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprintSet bounds the number of distinct fingerprints reported, so the
+// cardinality of the `fingerprint` label cannot grow indefinitely.
+type fingerprintSet struct {
+	mu   sync.RWMutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newFingerprintSet(max int) *fingerprintSet {
+	if max <= 0 {
+		max = defaultMaxFingerprints
+	}
+	return &fingerprintSet{
+		max:  max,
+		seen: make(map[string]struct{}, max),
+	}
+}
+
+// bound returns the fingerprint itself if it is already known or there is
+// still room for it. Otherwise, OtherFingerprint is returned.
+func (set *fingerprintSet) bound(fingerprint string) string {
+	set.mu.RLock()
+	_, ok := set.seen[fingerprint]
+	set.mu.RUnlock()
+	if ok {
+		return fingerprint
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if _, ok := set.seen[fingerprint]; ok {
+		return fingerprint
+	}
+	if len(set.seen) >= set.max {
+		return OtherFingerprint
+	}
+	set.seen[fingerprint] = struct{}{}
+	return fingerprint
+}
@@ -0,0 +1,72 @@
+package promsql
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lab259/go-rscsrv-prometheus/ginkgotest"
+)
+
+func TestPromsqlStatement(t *testing.T) {
+	ginkgotest.Init("Promsql Statement Test Suite", t)
+}
+
+var _ = Describe("Statement", func() {
+	When("classifying", func() {
+		scenarios := []struct {
+			query string
+			verb  string
+			table string
+		}{
+			{"SELECT id, name FROM users WHERE id = $1", "select", "users"},
+			{"select * from public.Users u inner join roles r on r.id = u.role_id", "select", "public.users"},
+			{"SELECT (SELECT count(*) FROM roles) FROM \"Users\"", "select", "Users"},
+			{"WITH t AS (SELECT id FROM roles) SELECT * FROM t", "select", "t"},
+			{"-- fetch users\nSELECT 1", "select", ""},
+			{"INSERT INTO users (id, name) VALUES (1, 'john')", "insert", "users"},
+			{"UPDATE ONLY users SET name = 'john' WHERE id = 1", "update", "users"},
+			{"DELETE FROM users WHERE id = 1", "delete", "users"},
+			{"CREATE TABLE IF NOT EXISTS users (id int)", "ddl", "users"},
+			{"DROP TABLE users", "ddl", "users"},
+			{"TRUNCATE users", "ddl", "users"},
+			{"BEGIN", "other", ""},
+			{"", "other", ""},
+		}
+
+		for _, sc := range scenarios {
+			sc := sc
+			It(fmt.Sprintf("should classify %q", sc.query), func() {
+				verb, table := classifyStatement(sc.query)
+				Expect(verb).To(Equal(sc.verb))
+				Expect(table).To(Equal(sc.table))
+			})
+		}
+	})
+
+	When("fingerprinting", func() {
+		It("should strip literals and placeholders", func() {
+			Expect(fingerprintStatement("SELECT name FROM users WHERE id = 1 AND name = 'o''brien'")).To(Equal("select name from users where id = ? and name = ?"))
+			Expect(fingerprintStatement("select name\n\tfrom users where id = $1")).To(Equal("select name from users where id = ?"))
+		})
+
+		It("should collapse lists of values", func() {
+			Expect(fingerprintStatement("SELECT * FROM users WHERE id IN (1, 2, 3)")).To(Equal("select * from users where id in (?)"))
+			Expect(fingerprintStatement("SELECT * FROM users WHERE id IN (4)")).To(Equal("select * from users where id in (?)"))
+		})
+
+		It("should keep casts", func() {
+			Expect(fingerprintStatement("SELECT $1::int")).To(Equal("select ? :: int"))
+		})
+
+		It("should bound the number of fingerprints", func() {
+			set := newFingerprintSet(2)
+			Expect(set.bound("a")).To(Equal("a"))
+			Expect(set.bound("b")).To(Equal("b"))
+			Expect(set.bound("c")).To(Equal(OtherFingerprint))
+			Expect(set.bound("a")).To(Equal("a"))
+		})
+	})
+})
@@ -0,0 +1,237 @@
+package promsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatementOrder defines how `StatementTracker.Top` sorts the statements.
+type StatementOrder string
+
+// Orders supported by `StatementTracker.Top`, all of them descending.
+const (
+	OrderByTotalDuration StatementOrder = "total"
+	OrderByMeanDuration  StatementOrder = "mean"
+	OrderByMaxDuration   StatementOrder = "max"
+	OrderByCount         StatementOrder = "count"
+)
+
+// ParseStatementOrder parses the name of a StatementOrder. An empty string
+// is parsed as OrderByTotalDuration.
+func ParseStatementOrder(s string) (StatementOrder, error) {
+	switch order := StatementOrder(s); order {
+	case "":
+		return OrderByTotalDuration, nil
+	case OrderByTotalDuration, OrderByMeanDuration, OrderByMaxDuration, OrderByCount:
+		return order, nil
+	}
+	return "", fmt.Errorf("promsql: invalid statement order %q", s)
+}
+
+// defaultMaxStatements is the number of statements tracked when
+// StatementTrackerOpts.MaxStatements is not set.
+const defaultMaxStatements = 100
+
+// StatementStats aggregates the executions of the statements sharing the
+// same fingerprint.
+type StatementStats struct {
+	Fingerprint   string
+	Count         int64
+	Errors        int64
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+	LastError     string
+	FirstSeen     time.Time
+	LastSeen      time.Time
+}
+
+// MeanDuration returns the average duration of the statement.
+func (s StatementStats) MeanDuration() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Count)
+}
+
+// MarshalJSON reports the durations in seconds.
+func (s StatementStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Fingerprint  string    `json:"fingerprint"`
+		Count        int64     `json:"count"`
+		Errors       int64     `json:"errors"`
+		TotalSeconds float64   `json:"total_seconds"`
+		MeanSeconds  float64   `json:"mean_seconds"`
+		MaxSeconds   float64   `json:"max_seconds"`
+		LastError    string    `json:"last_error,omitempty"`
+		FirstSeen    time.Time `json:"first_seen"`
+		LastSeen     time.Time `json:"last_seen"`
+	}{
+		Fingerprint:  s.Fingerprint,
+		Count:        s.Count,
+		Errors:       s.Errors,
+		TotalSeconds: s.TotalDuration.Seconds(),
+		MeanSeconds:  s.MeanDuration().Seconds(),
+		MaxSeconds:   s.MaxDuration.Seconds(),
+		LastError:    s.LastError,
+		FirstSeen:    s.FirstSeen,
+		LastSeen:     s.LastSeen,
+	})
+}
+
+// StatementTrackerOpts is the input option for StatementTracker.
+type StatementTrackerOpts struct {
+	// MaxStatements limits the number of fingerprints tracked. Once it is
+	// reached, the fingerprint with the lowest total duration per second
+	// since it was first seen is evicted to make room for new ones, so a new
+	// statement is not evicted right away by the next one just because it
+	// had little time to add up. Defaults to 100.
+	MaxStatements int
+}
+
+// StatementTracker keeps a bounded in-memory table of the statements
+// executed, aggregated by fingerprint, much like `pg_stat_statements` but on
+// the application side.
+//
+// It is a DriverHooks, so it can be plugged into a `DriverCollector`:
+//
+// ```
+// tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+// collector, err := promsql.Register(promsql.DriverCollectorOpts{DriverName: "postgres", Hooks: tracker})
+// ```
+//
+// The queries run through a `Query` proxy are only tracked if the driver is
+// wrapped this way, or if the tracker is set as the `Statements` of their
+// `QueryCollectorOpts`.
+type StatementTracker struct {
+	mu         sync.Mutex
+	max        int
+	statements map[string]*StatementStats
+}
+
+// NewStatementTracker returns a new instance of *StatementTracker.
+func NewStatementTracker(opts StatementTrackerOpts) *StatementTracker {
+	max := opts.MaxStatements
+	if max <= 0 {
+		max = defaultMaxStatements
+	}
+	return &StatementTracker{
+		max:        max,
+		statements: make(map[string]*StatementStats, max),
+	}
+}
+
+// Before implements DriverHooks.
+func (t *StatementTracker) Before(ctx context.Context, op Op, query string, args []driver.NamedValue) context.Context {
+	return ctx
+}
+
+// After implements DriverHooks, observing queries and executions.
+func (t *StatementTracker) After(ctx context.Context, op Op, query string, args []driver.NamedValue, result interface{}, err error, duration time.Duration) {
+	if query == "" {
+		return
+	}
+	t.Observe(query, duration, err)
+}
+
+// Observe records an execution of the statement.
+func (t *StatementTracker) Observe(query string, duration time.Duration, err error) {
+	fingerprint := fingerprintStatement(query)
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.statements[fingerprint]
+	if !ok {
+		if len(t.statements) >= t.max {
+			t.evict(now)
+		}
+		stats = &StatementStats{Fingerprint: fingerprint, FirstSeen: now}
+		t.statements[fingerprint] = stats
+	}
+
+	stats.Count++
+	stats.TotalDuration += duration
+	if duration > stats.MaxDuration {
+		stats.MaxDuration = duration
+	}
+	if err != nil {
+		stats.Errors++
+		stats.LastError = err.Error()
+	}
+	stats.LastSeen = now
+}
+
+// minStatementAge is the age the statements younger than it are considered
+// to have by evict, so the rate of a statement just seen is not inflated.
+const minStatementAge = time.Second
+
+// evict removes the statement with the lowest total duration per second
+// since it was first seen.
+func (t *StatementTracker) evict(now time.Time) {
+	var (
+		victim     *StatementStats
+		victimRate float64
+	)
+	for _, stats := range t.statements {
+		age := now.Sub(stats.FirstSeen)
+		if age < minStatementAge {
+			age = minStatementAge
+		}
+		rate := stats.TotalDuration.Seconds() / age.Seconds()
+		if victim == nil || rate < victimRate {
+			victim, victimRate = stats, rate
+		}
+	}
+	if victim != nil {
+		delete(t.statements, victim.Fingerprint)
+	}
+}
+
+// Top returns up to `n` statements sorted by the given order. If `n` is not
+// positive, all the statements tracked are returned.
+func (t *StatementTracker) Top(n int, order StatementOrder) []StatementStats {
+	t.mu.Lock()
+	statements := make([]StatementStats, 0, len(t.statements))
+	for _, stats := range t.statements {
+		statements = append(statements, *stats)
+	}
+	t.mu.Unlock()
+
+	var key func(s StatementStats) int64
+	switch order {
+	case OrderByMeanDuration:
+		key = func(s StatementStats) int64 { return int64(s.MeanDuration()) }
+	case OrderByMaxDuration:
+		key = func(s StatementStats) int64 { return int64(s.MaxDuration) }
+	case OrderByCount:
+		key = func(s StatementStats) int64 { return s.Count }
+	default:
+		key = func(s StatementStats) int64 { return int64(s.TotalDuration) }
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		ki, kj := key(statements[i]), key(statements[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return statements[i].Fingerprint < statements[j].Fingerprint
+	})
+
+	if n > 0 && n < len(statements) {
+		statements = statements[:n]
+	}
+	return statements
+}
+
+// Reset forgets all the statements tracked.
+func (t *StatementTracker) Reset() {
+	t.mu.Lock()
+	t.statements = make(map[string]*StatementStats, t.max)
+	t.mu.Unlock()
+}
@@ -0,0 +1,97 @@
+package promsql_test
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lab259/go-rscsrv-prometheus/promsql"
+)
+
+var _ = Describe("Statement Tracker", func() {
+	It("should aggregate statements by fingerprint", func() {
+		tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		tracker.Observe("SELECT * FROM users WHERE id = 1", 2*time.Second, nil)
+		tracker.Observe("SELECT * FROM users WHERE id = 2", 4*time.Second, errors.New("timeout"))
+		tracker.Observe("UPDATE users SET name = 'john'", time.Second, nil)
+
+		top := tracker.Top(0, promsql.OrderByTotalDuration)
+		Expect(top).To(HaveLen(2))
+		Expect(top[0].Fingerprint).To(Equal("select * from users where id = ?"))
+		Expect(top[0].Count).To(BeEquivalentTo(2))
+		Expect(top[0].Errors).To(BeEquivalentTo(1))
+		Expect(top[0].TotalDuration).To(Equal(6 * time.Second))
+		Expect(top[0].MeanDuration()).To(Equal(3 * time.Second))
+		Expect(top[0].MaxDuration).To(Equal(4 * time.Second))
+		Expect(top[0].LastError).To(Equal("timeout"))
+
+		data, err := json.Marshal(top[0])
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"mean_seconds":3`))
+	})
+
+	It("should sort and limit the statements", func() {
+		tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT 1", time.Second, nil)
+		tracker.Observe("SELECT a FROM b", 2*time.Second, nil)
+
+		Expect(tracker.Top(1, promsql.OrderByCount)[0].Fingerprint).To(Equal("select ?"))
+		Expect(tracker.Top(1, promsql.OrderByMaxDuration)[0].Fingerprint).To(Equal("select a from b"))
+		Expect(tracker.Top(0, promsql.OrderByMeanDuration)).To(HaveLen(2))
+
+		_, err := promsql.ParseStatementOrder("slowest")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should evict the statement with the lowest total duration", func() {
+		tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{MaxStatements: 2})
+		tracker.Observe("SELECT a FROM b", 2*time.Second, nil)
+		tracker.Observe("SELECT c FROM d", time.Second, nil)
+		tracker.Observe("SELECT e FROM f", 3*time.Second, nil)
+
+		top := tracker.Top(0, promsql.OrderByTotalDuration)
+		Expect(top).To(HaveLen(2))
+		Expect(top[0].Fingerprint).To(Equal("select e from f"))
+		Expect(top[1].Fingerprint).To(Equal("select a from b"))
+
+		tracker.Reset()
+		Expect(tracker.Top(0, promsql.OrderByTotalDuration)).To(BeEmpty())
+	})
+
+	It("should track the statements of a DriverCollector", func() {
+		tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		db := openFakeDB(promsql.Wrap(&fakeDriver{}, promsql.DriverCollectorOpts{Hooks: tracker}))
+		defer db.Close()
+
+		_, err := db.Exec("update users set name = $1", "john")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.Exec("update fail")
+		Expect(err).To(HaveOccurred())
+
+		top := tracker.Top(0, promsql.OrderByCount)
+		Expect(top).To(HaveLen(2))
+		Expect(top[0].Fingerprint).To(Equal("update fail"))
+		Expect(top[0].LastError).To(Equal(errFakeQuery.Error()))
+	})
+
+	It("should track the statements of a QueryCollector", func() {
+		tracker := promsql.NewStatementTracker(promsql.StatementTrackerOpts{})
+		collector := promsql.NewQueryCollector(&promsql.QueryCollectorOpts{Statements: tracker})
+		db := openFakeDB(&fakeDriver{})
+		defer db.Close()
+
+		_, err := promsql.NewQuery(collector.NewNamedQuery("users"), db).Exec("fail")
+		Expect(err).To(HaveOccurred())
+
+		top := tracker.Top(0, promsql.OrderByCount)
+		Expect(top).To(HaveLen(1))
+		Expect(top[0].Fingerprint).To(Equal("fail"))
+		Expect(top[0].Errors).To(BeEquivalentTo(1))
+		Expect(top[0].FirstSeen).ToNot(BeZero())
+	})
+})
@@ -0,0 +1,12 @@
+//go:build go1.15
+// +build go1.15
+
+package promsql
+
+import "database/sql"
+
+// maxIdleTimeClosed returns `sql.DBStats.MaxIdleTimeClosed`, available from
+// Go 1.15 on.
+func maxIdleTimeClosed(stats sql.DBStats) (int64, bool) {
+	return stats.MaxIdleTimeClosed, true
+}
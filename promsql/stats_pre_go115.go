@@ -0,0 +1,12 @@
+//go:build !go1.15
+// +build !go1.15
+
+package promsql
+
+import "database/sql"
+
+// maxIdleTimeClosed reports that `sql.DBStats.MaxIdleTimeClosed` is not
+// available before Go 1.15.
+func maxIdleTimeClosed(stats sql.DBStats) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,5 @@
+-- name: fetch_roles
+SELECT id FROM roles;
+
+-- name: fetch_users
+SELECT id FROM users;
@@ -0,0 +1,2 @@
+-- name: fetch_users
+SELECT id, name FROM users;
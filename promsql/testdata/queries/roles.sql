@@ -0,0 +1,2 @@
+-- name: fetch_roles
+SELECT id, name FROM roles;
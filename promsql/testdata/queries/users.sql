@@ -0,0 +1,9 @@
+-- Queries of the users repository.
+
+-- name: fetch_users
+SELECT id, name
+FROM users
+WHERE active = $1;
+
+-- name: update_user_name
+UPDATE users SET name = $1 WHERE id = $2;